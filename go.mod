@@ -2,10 +2,13 @@ module github.com/mshort2/distributed-rate-limiter
 
 go 1.24.4
 
+require (
+	github.com/go-redis/redis/v8 v8.11.5
+	github.com/joho/godotenv v1.5.1
+)
+
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/go-redis/redis/v8 v8.11.5 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
 	github.com/redis/go-redis/v9 v9.11.0 // indirect
 )
@@ -3,6 +3,7 @@ package config
 import (
     "os"
     "strconv"
+    "strings"
     "time"
 )
 
@@ -10,6 +11,7 @@ type Config struct {
     Server   ServerConfig
     Redis    RedisConfig
     RateLimit RateLimitConfig
+    Store    StoreConfig
 }
 
 type ServerConfig struct {
@@ -19,15 +21,96 @@ type ServerConfig struct {
 }
 
 type RedisConfig struct {
-    Host     string
-    Port     string
-    Password string
-    DB       int
+    Host         string
+    Port         string
+    Password     string
+    DB           int
+    // ClusterAddrs, when set, are the seed nodes of a Redis Cluster and
+    // Host, Port and DB are ignored.
+    ClusterAddrs []string
+    // ShardAddrs, when set, are independent Redis servers that keys are
+    // spread over by rendezvous hashing, and Host and Port are ignored.
+    // Keys used together must share a hash tag, as with ClusterAddrs.
+    ShardAddrs   []string
+    // SentinelAddrs, when set, are the Sentinels that monitor
+    // SentinelMaster; the client follows the master through failovers and
+    // Host and Port are ignored.
+    SentinelAddrs    []string
+    SentinelMaster   string
+    SentinelPassword string
+    // PoolSize is the number of connections per node.
+    PoolSize         int
+    // OpTimeout bounds each command, including go-redis retries.
+    OpTimeout        time.Duration
+    MaxRetries       int
+    // After BreakerThreshold consecutive failures the circuit opens and
+    // commands fail immediately for BreakerCooldown; zero disables it.
+    BreakerThreshold int
+    BreakerCooldown  time.Duration
+}
+
+// StoreConfig selects where limiter state lives.
+type StoreConfig struct {
+    // Backend is "redis" or "memory". The memory backend keeps state in
+    // the process, so each node enforces its limits on its own.
+    Backend               string
+    // MemoryShards is the number of independently locked maps.
+    MemoryShards          int
+    // MemoryCleanupInterval is how often expired keys are removed.
+    MemoryCleanupInterval time.Duration
 }
 
 type RateLimitConfig struct {
-    DefaultLimit  int
-    DefaultWindow time.Duration
+    Algorithm      string
+    DefaultLimit   int
+    DefaultWindow  time.Duration
+    // Burst is the token bucket capacity; zero means DefaultLimit.
+    Burst          int
+    // Limits, when set, are enforced together on every key instead of
+    // DefaultLimit and DefaultWindow.
+    Limits         []LimitRule
+    // KeyLimits, when set, give keys starting with their KeyPrefix their
+    // own limit and algorithm; other keys get the limits above.
+    KeyLimits      []LimitRule
+    // OrgLimit and GlobalLimit enable hierarchical checks that also charge
+    // the caller's organization and a service-wide budget; zero disables.
+    OrgLimit       int
+    OrgWindow      time.Duration
+    GlobalLimit    int
+    GlobalWindow   time.Duration
+    // HoldTimeout is how long reserved quota is held when the caller does
+    // not give a timeout.
+    HoldTimeout    time.Duration
+    // FailurePolicy decides checks while the store is unreachable: "error"
+    // fails them, "open" allows, "closed" denies and "local" enforces the
+    // limits per node in memory, divided by NodeCount.
+    FailurePolicy  string
+    NodeCount      int
+    // CoalesceWindow, when set, makes sliding log checks that arrive within
+    // it of each other share one pipelined round trip to Redis.
+    CoalesceWindow time.Duration
+    // LeaseSize, when set, makes the default limit a fixed window from
+    // which each node leases LeaseSize units at a time and admits requests
+    // locally; Algorithm is ignored. Unspent units are given back after
+    // LeaseTTL.
+    LeaseSize      int
+    LeaseTTL       time.Duration
+    // DenyCacheSize, when set, is the number of denied keys each node
+    // remembers until their retry time and denies without a store call.
+    DenyCacheSize  int
+    // TimeSource is "local" to use each node's clock, or "redis" to have
+    // scripts read the time from Redis so that skewed nodes agree on
+    // windows.
+    TimeSource     string
+}
+
+type LimitRule struct {
+    Limit  int
+    Window time.Duration
+    // KeyPrefix and Algorithm are only used by KeyLimits; the rules of
+    // Limits are all enforced by the sliding log.
+    KeyPrefix string
+    Algorithm string
 }
 
 func Load() *Config {
@@ -38,14 +121,47 @@ func Load() *Config {
             WriteTimeout: getDuration("WRITE_TIMEOUT", 10*time.Second),
         },
         Redis: RedisConfig{
-            Host:     getEnv("REDIS_HOST", "localhost"),
-            Port:     getEnv("REDIS_PORT", "6379"),
-            Password: getEnv("REDIS_PASSWORD", ""),
-            DB:       getEnvInt("REDIS_DB", 0),
+            Host:         getEnv("REDIS_HOST", "localhost"),
+            Port:         getEnv("REDIS_PORT", "6379"),
+            Password:     getEnv("REDIS_PASSWORD", ""),
+            DB:           getEnvInt("REDIS_DB", 0),
+            ClusterAddrs: getList("REDIS_CLUSTER_ADDRS"),
+            ShardAddrs:   getList("REDIS_SHARD_ADDRS"),
+
+            SentinelAddrs:    getList("REDIS_SENTINEL_ADDRS"),
+            SentinelMaster:   getEnv("REDIS_SENTINEL_MASTER", "mymaster"),
+            SentinelPassword: getEnv("REDIS_SENTINEL_PASSWORD", ""),
+
+            PoolSize:         getEnvInt("REDIS_POOL_SIZE", 20),
+            OpTimeout:        getDuration("REDIS_OP_TIMEOUT", 250*time.Millisecond),
+            MaxRetries:       getEnvInt("REDIS_MAX_RETRIES", 3),
+            BreakerThreshold: getEnvInt("REDIS_BREAKER_THRESHOLD", 5),
+            BreakerCooldown:  getDuration("REDIS_BREAKER_COOLDOWN", 5*time.Second),
         },
         RateLimit: RateLimitConfig{
-            DefaultLimit:  getEnvInt("DEFAULT_LIMIT", 100),
-            DefaultWindow: getDuration("DEFAULT_WINDOW", time.Minute),
+            Algorithm:      getEnv("RATE_LIMIT_ALGORITHM", "sliding_log"),
+            DefaultLimit:   getEnvInt("DEFAULT_LIMIT", 100),
+            DefaultWindow:  getDuration("DEFAULT_WINDOW", time.Minute),
+            Burst:          getEnvInt("RATE_LIMIT_BURST", 0),
+            Limits:         getLimits("RATE_LIMITS"),
+            KeyLimits:      getKeyLimits("KEY_LIMITS"),
+            OrgLimit:       getEnvInt("ORG_LIMIT", 0),
+            OrgWindow:      getDuration("ORG_WINDOW", time.Minute),
+            GlobalLimit:    getEnvInt("GLOBAL_LIMIT", 0),
+            GlobalWindow:   getDuration("GLOBAL_WINDOW", time.Minute),
+            HoldTimeout:    getDuration("HOLD_TIMEOUT", 5*time.Minute),
+            FailurePolicy:  getEnv("FAILURE_POLICY", "error"),
+            NodeCount:      getEnvInt("NODE_COUNT", 1),
+            CoalesceWindow: getDuration("COALESCE_WINDOW", 0),
+            LeaseSize:      getEnvInt("LEASE_SIZE", 0),
+            LeaseTTL:       getDuration("LEASE_TTL", time.Second),
+            DenyCacheSize:  getEnvInt("DENY_CACHE_SIZE", 0),
+            TimeSource:     getEnv("TIME_SOURCE", "local"),
+        },
+        Store: StoreConfig{
+            Backend:               getEnv("STORE", "redis"),
+            MemoryShards:          getEnvInt("MEMORY_SHARDS", 64),
+            MemoryCleanupInterval: getDuration("MEMORY_CLEANUP_INTERVAL", time.Minute),
         },
     }
 }
@@ -73,4 +189,68 @@ func getDuration(key string, defaultValue time.Duration) time.Duration {
         }
     }
     return defaultValue
-}
\ No newline at end of file
+}
+
+// getList parses a comma separated list, ignoring empty entries.
+func getList(key string) []string {
+    var values []string
+    for _, value := range strings.Split(os.Getenv(key), ",") {
+        if value = strings.TrimSpace(value); value != "" {
+            values = append(values, value)
+        }
+    }
+    return values
+}
+
+// getLimits parses a comma separated list of limit/window pairs such as
+// "10/1s,1000/1h". Malformed entries are skipped.
+func getLimits(key string) []LimitRule {
+    var rules []LimitRule
+    for _, entry := range strings.Split(os.Getenv(key), ",") {
+        limit, window, ok := strings.Cut(strings.TrimSpace(entry), "/")
+        if !ok {
+            continue
+        }
+        l, err := strconv.Atoi(limit)
+        if err != nil {
+            continue
+        }
+        d, err := time.ParseDuration(window)
+        if err != nil {
+            continue
+        }
+        rules = append(rules, LimitRule{Limit: l, Window: d})
+    }
+    return rules
+}
+
+// getKeyLimits parses a comma separated list of prefix=algorithm:limit/window
+// entries such as "bulk-=sliding_window:1000/1m,pay-=sliding_log:10/1m".
+// Malformed entries are skipped.
+func getKeyLimits(key string) []LimitRule {
+    var rules []LimitRule
+    for _, entry := range strings.Split(os.Getenv(key), ",") {
+        prefix, rule, ok := strings.Cut(strings.TrimSpace(entry), "=")
+        if !ok || prefix == "" {
+            continue
+        }
+        algorithm, rate, ok := strings.Cut(rule, ":")
+        if !ok {
+            continue
+        }
+        limit, window, ok := strings.Cut(rate, "/")
+        if !ok {
+            continue
+        }
+        l, err := strconv.Atoi(limit)
+        if err != nil {
+            continue
+        }
+        d, err := time.ParseDuration(window)
+        if err != nil {
+            continue
+        }
+        rules = append(rules, LimitRule{Limit: l, Window: d, KeyPrefix: prefix, Algorithm: algorithm})
+    }
+    return rules
+}
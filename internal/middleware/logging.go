@@ -68,7 +68,7 @@ func CORS(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Access-Control-Allow-Origin", "*")
         w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Client-ID")
+        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Client-ID, X-Org-ID")
         
         if r.Method == "OPTIONS" {
             w.WriteHeader(http.StatusOK)
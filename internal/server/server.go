@@ -3,10 +3,14 @@ package server
 import (
     "context"
     "encoding/json"
+    "errors"
+    "fmt"
+    "io"
     "log"
     "net/http"
     "os"
     "os/signal"
+    "strconv"
     "syscall"
     "time"
 
@@ -18,19 +22,34 @@ import (
 type Server struct {
     config    *config.Config
     server    *http.Server
-    rl        *limiter.SlidingWindowLimiter
+    rl        limiter.Limiter
     startTime time.Time
 }
 
 func NewServer(cfg *config.Config) *Server {
+    rl, err := limiter.New(cfg)
+    if err != nil {
+        log.Fatalf("Failed to create rate limiter: %v", err)
+    }
+    return NewServerWithLimiter(cfg, rl)
+}
+
+// NewServerWithLimiter builds a server around an existing limiter, which lets
+// callers choose the algorithm or substitute a fake in tests.
+func NewServerWithLimiter(cfg *config.Config, rl limiter.Limiter) *Server {
     mux := http.NewServeMux()
     srv := &Server{
         config:    cfg,
+        rl:        rl,
         startTime: time.Now(),
     }
 
     mux.HandleFunc("/health", srv.healthHandler)
     mux.HandleFunc("/check", srv.rateLimitHandler)
+    mux.HandleFunc("/check/batch", srv.batchHandler)
+    mux.HandleFunc("/check/reserve", srv.reserveHandler)
+    mux.HandleFunc("/check/commit", srv.commitHandler)
+    mux.HandleFunc("/check/cancel", srv.cancelHandler)
     mux.HandleFunc("/admin/stats", srv.statsHandler)
     mux.HandleFunc("/admin/config", srv.configHandler)
 
@@ -48,40 +67,331 @@ func NewServer(cfg *config.Config) *Server {
         WriteTimeout: cfg.Server.WriteTimeout,
     }
 
-    rl, err := limiter.NewRateLimiter(cfg, cfg.RateLimit.DefaultLimit, cfg.RateLimit.DefaultWindow)
-    if err != nil {
-        log.Fatalf("Failed to create rate limiter: %v", err)
-    }
-    srv.rl = rl
-
     return srv
 }
 
 func (s *Server) rateLimitHandler(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
+    dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+    if r.Method != http.MethodPost && !(dryRun && r.Method == http.MethodGet) {
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
 
+    req, err := decodeCheckRequest(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if dryRun {
+        s.dryRunCheck(w, r, req)
+        return
+    }
+
     clientID := extractClientID(r)
     requestID := r.Header.Get("X-Request-ID")
 
-    response, err := s.rl.Allow(r.Context(), clientID, requestID)
+    var response limiter.RateLimitResponse
+    if scoped, ok := s.rl.(limiter.ScopedLimiter); ok {
+        scope := limiter.Scope{Org: extractOrgID(r, req), User: clientID}
+        response, err = scoped.AllowScoped(r.Context(), scope, requestID, req.Cost)
+    } else {
+        response, err = s.rl.AllowN(r.Context(), clientID, requestID, req.Cost)
+    }
     if err != nil {
         http.Error(w, "Rate limiter error", http.StatusInternalServerError)
         return
     }
 
+    w.Header().Set("Content-Type", "application/json")
     if response.Allowed {
         w.WriteHeader(http.StatusOK)
     } else {
+        setRetryAfter(w, response)
         w.WriteHeader(http.StatusTooManyRequests)
     }
+    json.NewEncoder(w).Encode(response)
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounded up so
+// that clients never retry early.
+func setRetryAfter(w http.ResponseWriter, response limiter.RateLimitResponse) {
+    seconds := (response.RetryAfterMs + 999) / 1000
+    w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// dryRunCheck reports whether a check for req.Cost units would be allowed
+// without consuming any quota. It always answers 200 since nothing was
+// rejected.
+func (s *Server) dryRunCheck(w http.ResponseWriter, r *http.Request, req checkRequest) {
+    clientID := extractClientID(r)
+
+    var response limiter.RateLimitResponse
+    var err error
+    if scoped, ok := s.rl.(limiter.ScopedLimiter); ok {
+        scope := limiter.Scope{Org: extractOrgID(r, req), User: clientID}
+        response, err = scoped.PeekScoped(r.Context(), scope)
+    } else {
+        response, err = s.rl.Peek(r.Context(), clientID)
+    }
+    if err != nil {
+        http.Error(w, "Rate limiter error", http.StatusInternalServerError)
+        return
+    }
+    response.Allowed = response.Remaining >= req.Cost
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(response)
 }
 
+// checkRequest is the optional JSON body of POST /check. The same fields may
+// be given as query parameters, which take precedence.
+type checkRequest struct {
+    // Cost is the number of units to consume; it defaults to 1.
+    Cost int `json:"cost"`
+    // OrgID selects the organization charged by hierarchical limiters.
+    OrgID string `json:"org_id"`
+}
+
+func decodeCheckRequest(r *http.Request) (checkRequest, error) {
+    var req checkRequest
+    if r.Body != nil {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+            return req, fmt.Errorf("invalid request body: %w", err)
+        }
+    }
+    query := r.URL.Query()
+    if cost := query.Get("cost"); cost != "" {
+        n, err := strconv.Atoi(cost)
+        if err != nil {
+            return req, fmt.Errorf("invalid cost %q", cost)
+        }
+        req.Cost = n
+    }
+    if orgID := query.Get("org_id"); orgID != "" {
+        req.OrgID = orgID
+    }
+    if req.Cost == 0 {
+        req.Cost = 1
+    }
+    if req.Cost < 0 {
+        return req, fmt.Errorf("invalid cost %d", req.Cost)
+    }
+    return req, nil
+}
+
+// maxBatchSize is the most checks accepted by one POST /check/batch.
+const maxBatchSize = 100
+
+// batchRequest is the JSON body of POST /check/batch.
+type batchRequest struct {
+    Checks []batchCheck `json:"checks"`
+}
+
+type batchCheck struct {
+    Key       string `json:"key"`
+    Cost      int    `json:"cost"`
+    RequestID string `json:"request_id"`
+    OrgID     string `json:"org_id"`
+}
+
+// batchResult is one item of the POST /check/batch response. Exactly one of
+// the decision and Error is set.
+type batchResult struct {
+    *limiter.RateLimitResponse
+    Error string `json:"error,omitempty"`
+}
+
+// batchHandler makes every check in the body and reports each decision
+// separately. It answers 200 even when checks are denied or fail, since the
+// batch itself succeeded.
+func (s *Server) batchHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req batchRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+        return
+    }
+    if len(req.Checks) > maxBatchSize {
+        http.Error(w, fmt.Sprintf("too many checks: at most %d are allowed", maxBatchSize), http.StatusBadRequest)
+        return
+    }
+
+    // Checks without a key are answered without reaching the limiter.
+    results := make([]batchResult, len(req.Checks))
+    var checks []limiter.Check
+    var index []int
+    for i, c := range req.Checks {
+        if c.Key == "" {
+            results[i].Error = "key is required"
+            continue
+        }
+        if c.Cost == 0 {
+            c.Cost = 1
+        }
+        checks = append(checks, limiter.Check{Key: c.Key, RequestID: c.RequestID, Cost: c.Cost, Org: c.OrgID})
+        index = append(index, i)
+    }
+
+    for i, result := range limiter.AllowBatch(r.Context(), s.rl, checks) {
+        if result.Err != nil {
+            results[index[i]].Error = result.Err.Error()
+            continue
+        }
+        response := result.Response
+        results[index[i]].RateLimitResponse = &response
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "results": results,
+    })
+}
+
+// holdRequest is the JSON body of the /check/reserve, /check/commit and
+// /check/cancel endpoints.
+type holdRequest struct {
+    HoldID    string `json:"hold_id"`
+    Cost      int    `json:"cost"`
+    Used      int    `json:"used"`
+    TimeoutMs int64  `json:"timeout_ms"`
+}
+
+// validate checks the fields op ("reserve", "commit" or "cancel") uses.
+// Neither a cost nor units used can exceed capacity, when it is known, as no
+// hold can be that large.
+func (req *holdRequest) validate(op string, capacity int) error {
+    switch op {
+    case "reserve":
+        if req.Cost == 0 {
+            req.Cost = 1
+        }
+        if req.Cost < 0 {
+            return fmt.Errorf("invalid cost %d", req.Cost)
+        }
+        if capacity > 0 && req.Cost > capacity {
+            return fmt.Errorf("invalid cost %d: the limit allows at most %d", req.Cost, capacity)
+        }
+        if req.TimeoutMs < 0 {
+            return fmt.Errorf("invalid timeout_ms %d", req.TimeoutMs)
+        }
+        return nil
+    case "commit":
+        if req.Used < 0 {
+            return fmt.Errorf("invalid used %d", req.Used)
+        }
+        if capacity > 0 && req.Used > capacity {
+            return fmt.Errorf("invalid used %d: the limit allows at most %d", req.Used, capacity)
+        }
+    }
+    if req.HoldID == "" {
+        return errors.New("hold_id is required")
+    }
+    return nil
+}
+
+// decodeHoldRequest returns the limiter and validated request for the hold
+// endpoint op, or writes the error response and returns ok false.
+func (s *Server) decodeHoldRequest(w http.ResponseWriter, r *http.Request, op string) (limiter.HoldLimiter, holdRequest, bool) {
+    var req holdRequest
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return nil, req, false
+    }
+    hl, ok := s.rl.(limiter.HoldLimiter)
+    if !ok {
+        http.Error(w, "Reservations are not supported by this limiter", http.StatusNotImplemented)
+        return nil, req, false
+    }
+    if r.Body != nil {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+            http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+            return nil, req, false
+        }
+    }
+    capacity := 0
+    if c, ok := s.rl.(limiter.CapacityReporter); ok {
+        capacity = c.Capacity()
+    }
+    if err := req.validate(op, capacity); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return nil, req, false
+    }
+    return hl, req, true
+}
+
+func (s *Server) reserveHandler(w http.ResponseWriter, r *http.Request) {
+    hl, req, ok := s.decodeHoldRequest(w, r, "reserve")
+    if !ok {
+        return
+    }
+    timeout := s.config.RateLimit.HoldTimeout
+    if req.TimeoutMs > 0 {
+        timeout = time.Duration(req.TimeoutMs) * time.Millisecond
+    }
+
+    hold, err := hl.Hold(r.Context(), extractClientID(r), req.Cost, timeout)
+    if errors.Is(err, limiter.ErrHoldsNotSupported) {
+        http.Error(w, "Reservations are not supported for this key", http.StatusNotImplemented)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Rate limiter error", http.StatusInternalServerError)
+        return
+    }
+    hold.RequestID = r.Header.Get("X-Request-ID")
+
+    w.Header().Set("Content-Type", "application/json")
+    if !hold.Allowed {
+        setRetryAfter(w, hold.RateLimitResponse)
+        w.WriteHeader(http.StatusTooManyRequests)
+    }
+    json.NewEncoder(w).Encode(hold)
+}
+
+func (s *Server) commitHandler(w http.ResponseWriter, r *http.Request) {
+    hl, req, ok := s.decodeHoldRequest(w, r, "commit")
+    if !ok {
+        return
+    }
+    released, err := hl.Commit(r.Context(), extractClientID(r), req.HoldID, req.Used)
+    s.writeSettled(w, req.HoldID, released, err)
+}
+
+func (s *Server) cancelHandler(w http.ResponseWriter, r *http.Request) {
+    hl, req, ok := s.decodeHoldRequest(w, r, "cancel")
+    if !ok {
+        return
+    }
+    released, err := hl.Cancel(r.Context(), extractClientID(r), req.HoldID)
+    s.writeSettled(w, req.HoldID, released, err)
+}
+
+func (s *Server) writeSettled(w http.ResponseWriter, holdID string, released int, err error) {
+    if errors.Is(err, limiter.ErrHoldNotFound) {
+        http.Error(w, "Reservation not found or expired", http.StatusNotFound)
+        return
+    }
+    if errors.Is(err, limiter.ErrHoldsNotSupported) {
+        http.Error(w, "Reservations are not supported for this key", http.StatusNotImplemented)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Rate limiter error", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "hold_id":  holdID,
+        "released": released,
+    })
+}
+
 func extractClientID(r *http.Request) string {
     if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
         return apiKey
@@ -98,17 +408,34 @@ func extractClientID(r *http.Request) string {
     return r.RemoteAddr
 }
 
+func extractOrgID(r *http.Request, req checkRequest) string {
+    if orgID := r.Header.Get("X-Org-ID"); orgID != "" {
+        return orgID
+    }
+    return req.OrgID
+}
+
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
     redisHealth := "healthy"
     if err := s.rl.Health(r.Context()); err != nil {
         redisHealth = "unhealthy"
     }
 
-    health := map[string]string{
+    health := map[string]interface{}{
         "status":    redisHealth,
         "timestamp": time.Now().UTC().Format(time.RFC3339),
         "version":   "1.0.0",
     }
+    if cr, ok := s.rl.(limiter.CircuitReporter); ok {
+        if state := cr.CircuitState(); state != "" {
+            health["circuit"] = state
+        }
+    }
+    if sr, ok := s.rl.(limiter.ShardReporter); ok {
+        if shards := sr.ShardHealth(r.Context()); len(shards) > 0 {
+            health["shards"] = shards
+        }
+    }
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(health)
 }
@@ -120,6 +447,9 @@ func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
         "requests_denied":  50,
         "uptime_seconds":   time.Since(s.startTime).Seconds(),
     }
+    if dc, ok := s.rl.(limiter.DenyCacheReporter); ok {
+        stats["deny_cache"] = dc.DenyCacheStats()
+    }
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(stats)
 }
@@ -130,8 +460,27 @@ func (s *Server) configHandler(w http.ResponseWriter, r *http.Request) {
             "port": s.config.Server.Port,
         },
         "rate_limit": map[string]interface{}{
-            "default_limit":  s.config.RateLimit.DefaultLimit,
-            "default_window": s.config.RateLimit.DefaultWindow.String(),
+            "algorithm":       s.config.RateLimit.Algorithm,
+            "org_limit":       s.config.RateLimit.OrgLimit,
+            "org_window":      s.config.RateLimit.OrgWindow.String(),
+            "global_limit":    s.config.RateLimit.GlobalLimit,
+            "global_window":   s.config.RateLimit.GlobalWindow.String(),
+            "hold_timeout":    s.config.RateLimit.HoldTimeout.String(),
+            "burst":           s.config.RateLimit.Burst,
+            "default_limit":   s.config.RateLimit.DefaultLimit,
+            "default_window":  s.config.RateLimit.DefaultWindow.String(),
+            "limits":          s.config.RateLimit.Limits,
+            "key_limits":      s.config.RateLimit.KeyLimits,
+            "failure_policy":  s.config.RateLimit.FailurePolicy,
+            "node_count":      s.config.RateLimit.NodeCount,
+            "coalesce_window": s.config.RateLimit.CoalesceWindow.String(),
+            "lease_size":      s.config.RateLimit.LeaseSize,
+            "lease_ttl":       s.config.RateLimit.LeaseTTL.String(),
+            "deny_cache_size": s.config.RateLimit.DenyCacheSize,
+            "time_source":     s.config.RateLimit.TimeSource,
+        },
+        "store": map[string]interface{}{
+            "backend": s.config.Store.Backend,
         },
     }
     w.Header().Set("Content-Type", "application/json")
@@ -154,7 +503,10 @@ func (s *Server) Start() error {
     ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
     defer cancel()
 
-    return s.server.Shutdown(ctx)
+    if err := s.server.Shutdown(ctx); err != nil {
+        return err
+    }
+    return s.rl.Close()
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,131 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mshort2/distributed-rate-limiter/pkg/redis"
+)
+
+// Check is one item of a batch.
+type Check struct {
+	Key       string
+	RequestID string
+	Cost      int
+	// Org selects the organization charged by a ScopedLimiter.
+	Org string
+}
+
+// BatchResult is the outcome of one Check. Err is set instead of Response
+// when that check could not be made.
+type BatchResult struct {
+	Response RateLimitResponse
+	Err      error
+}
+
+// BatchLimiter is implemented by limiters that can make many checks in one
+// round trip to their store.
+type BatchLimiter interface {
+	AllowBatch(ctx context.Context, checks []Check) []BatchResult
+}
+
+// AllowBatch makes every check with l, in one round trip when l is a
+// BatchLimiter and one at a time otherwise. Checks run in order, so two
+// checks of the same key see each other's charges.
+func AllowBatch(ctx context.Context, l Limiter, checks []Check) []BatchResult {
+	if bl, ok := l.(BatchLimiter); ok {
+		return bl.AllowBatch(ctx, checks)
+	}
+	results := make([]BatchResult, len(checks))
+	for i, c := range checks {
+		results[i].Response, results[i].Err = allowScoped(ctx, l, Scope{Org: c.Org, User: c.Key}, c.RequestID, c.Cost)
+	}
+	return results
+}
+
+// scriptCall is a script invocation together with the decoding of its
+// reply, so that a check can run alone or pipelined with others.
+type scriptCall struct {
+	redis.ScriptCall
+	// name describes the script in errors.
+	name   string
+	decode func(result interface{}) (RateLimitResponse, error)
+}
+
+func newScriptCall(name, sha string, keys []string, args ...interface{}) scriptCall {
+	return scriptCall{
+		ScriptCall: redis.ScriptCall{SHA: sha, Keys: keys, Args: args},
+		name:       name,
+	}
+}
+
+// withRequestID makes the call report requestID in its response.
+func (c scriptCall) withRequestID(requestID string) scriptCall {
+	decode := c.decode
+	c.decode = func(result interface{}) (RateLimitResponse, error) {
+		resp, err := decode(result)
+		resp.RequestID = requestID
+		return resp, err
+	}
+	return c
+}
+
+// checkCalls adapts a limiter's allowCall to evalBatch.
+func checkCalls(allowCall func(key, requestID string, cost int) scriptCall) func(Check) (scriptCall, error) {
+	return func(c Check) (scriptCall, error) {
+		if err := validateCost(c.Cost); err != nil {
+			return scriptCall{}, err
+		}
+		return allowCall(c.Key, c.RequestID, c.Cost), nil
+	}
+}
+
+func evalCall(ctx context.Context, store Store, call scriptCall) (RateLimitResponse, error) {
+	result, err := store.EvalSha(ctx, call.SHA, call.Keys, call.Args...)
+	if err != nil {
+		return RateLimitResponse{}, fmt.Errorf("failed to execute %s script: %w", call.name, err)
+	}
+	return call.decode(result)
+}
+
+// evalBatch pipelines the calls built by build for each check. Checks that
+// build rejects are reported without being sent.
+func evalBatch(ctx context.Context, store Store, checks []Check, build func(Check) (scriptCall, error)) []BatchResult {
+	results := make([]BatchResult, len(checks))
+	calls := make([]scriptCall, 0, len(checks))
+	indexes := make([]int, 0, len(checks))
+	for i, c := range checks {
+		call, err := build(c)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		calls = append(calls, call)
+		indexes = append(indexes, i)
+	}
+	for i, result := range evalCalls(ctx, store, calls) {
+		results[indexes[i]] = result
+	}
+	return results
+}
+
+// evalCalls runs calls in one pipeline and decodes each reply.
+func evalCalls(ctx context.Context, store Store, calls []scriptCall) []BatchResult {
+	results := make([]BatchResult, len(calls))
+	if len(calls) == 0 {
+		return results
+	}
+
+	pipeline := make([]redis.ScriptCall, len(calls))
+	for i, call := range calls {
+		pipeline[i] = call.ScriptCall
+	}
+	for i, result := range store.EvalShaBatch(ctx, pipeline) {
+		if result.Err != nil {
+			results[i].Err = fmt.Errorf("failed to execute %s script: %w", calls[i].name, result.Err)
+			continue
+		}
+		results[i].Response, results[i].Err = calls[i].decode(result.Value)
+	}
+	return results
+}
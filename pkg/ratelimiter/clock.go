@@ -0,0 +1,75 @@
+package limiter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+)
+
+// Time sources accepted in config.RateLimitConfig.TimeSource.
+const (
+	TimeLocal = "local"
+	TimeRedis = "redis"
+)
+
+// Clock tells a limiter the time. Limiters use SystemClock unless their
+// Clock field is set, which lets tests move time without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock is the wall clock of this node.
+var SystemClock Clock = systemClock{}
+
+// serverTimeArg is passed to scripts in place of the time to make them read
+// the store's clock.
+const serverTimeArg = "redis"
+
+// clockLua defines script_time, which reads the time argument of a script
+// in units per second: the time given by the limiter, or with "redis" the
+// server's own clock, so that every node agrees on where windows start.
+const clockLua = `
+local function script_time(arg, unit)
+    if arg ~= "redis" then
+        return tonumber(arg)
+    end
+    local t = redis.call("TIME")
+    return tonumber(t[1]) * unit + math.floor(tonumber(t[2]) * unit / 1000000)
+end
+`
+
+// timing is the notion of time shared by the limiters.
+type timing struct {
+	Clock Clock
+	// serverTime makes scripts use the store's clock instead of Clock.
+	serverTime bool
+}
+
+func newTiming(cfg *config.Config) (timing, error) {
+	switch cfg.RateLimit.TimeSource {
+	case TimeLocal, "":
+		return timing{Clock: SystemClock}, nil
+	case TimeRedis:
+		return timing{Clock: SystemClock, serverTime: true}, nil
+	default:
+		return timing{}, fmt.Errorf("unknown time source %q", cfg.RateLimit.TimeSource)
+	}
+}
+
+func (t timing) now() time.Time {
+	return t.Clock.Now()
+}
+
+// scriptTime is the time argument for a script: now, or serverTimeArg when
+// the script should read the server's clock.
+func (t timing) scriptTime(now int64) interface{} {
+	if t.serverTime {
+		return serverTimeArg
+	}
+	return now
+}
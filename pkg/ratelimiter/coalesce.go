@@ -0,0 +1,94 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxCoalesced is the most calls sent in one pipeline; a full batch is sent
+// without waiting for the window to end.
+const maxCoalesced = 128
+
+// coalescer sends script calls made within window of each other to the
+// store as one pipeline and hands each caller its own result. The first
+// call of a batch waits up to window for others to join it.
+//
+// A call whose context ends while it waits returns ctx.Err(), but it has
+// already been queued and may still be charged when the batch is sent.
+type coalescer struct {
+	store  Store
+	window time.Duration
+
+	mu      sync.Mutex
+	pending []coalescedCall
+	timer   *time.Timer
+}
+
+type coalescedCall struct {
+	call scriptCall
+	done chan BatchResult
+}
+
+func newCoalescer(store Store, window time.Duration) *coalescer {
+	return &coalescer{store: store, window: window}
+}
+
+func (c *coalescer) eval(ctx context.Context, call scriptCall) (RateLimitResponse, error) {
+	done := make(chan BatchResult, 1)
+
+	c.mu.Lock()
+	c.pending = append(c.pending, coalescedCall{call: call, done: done})
+	switch {
+	case len(c.pending) >= maxCoalesced:
+		batch := c.take()
+		c.mu.Unlock()
+		c.send(batch)
+	case len(c.pending) == 1:
+		c.timer = time.AfterFunc(c.window, c.flush)
+		c.mu.Unlock()
+	default:
+		c.mu.Unlock()
+	}
+
+	select {
+	case result := <-done:
+		return result.Response, result.Err
+	case <-ctx.Done():
+		return RateLimitResponse{}, ctx.Err()
+	}
+}
+
+// take removes the pending batch. c.mu must be held.
+func (c *coalescer) take() []coalescedCall {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	batch := c.pending
+	c.pending = nil
+	return batch
+}
+
+// flush sends the pending batch, if any.
+func (c *coalescer) flush() {
+	c.mu.Lock()
+	batch := c.take()
+	c.mu.Unlock()
+	c.send(batch)
+}
+
+// send runs batch without any caller's context, since the calls belong to
+// different requests; each store operation is bounded by its own timeout.
+func (c *coalescer) send(batch []coalescedCall) {
+	if len(batch) == 0 {
+		return
+	}
+	calls := make([]scriptCall, len(batch))
+	for i, pending := range batch {
+		calls[i] = pending.call
+	}
+	for i, result := range evalCalls(context.Background(), c.store, calls) {
+		batch[i].done <- result
+	}
+}
@@ -0,0 +1,282 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DenyCache answers checks for keys that the limiter it wraps has recently
+// denied without asking it again. A denial is remembered until its retry
+// time, which the limiter computed from its stored state, so the cache
+// only answers checks that the limiter would also deny. A denial for cost
+// units also answers checks of greater cost.
+//
+// The cache is per node: a Reset on another node, a hold settled on another
+// node, or quota given back early by a lease, is not seen until the denial
+// runs out. Resets, commits and cancels made through the cache forget the
+// key's denial. A retry
+// with the request ID of an earlier admitted request is denied by the
+// cache rather than reported as a duplicate. Denials made by a failure
+// policy are not cached.
+type DenyCache struct {
+	limiter    Limiter
+	maxEntries int
+
+	mu      sync.RWMutex
+	entries map[string]denial
+
+	hits   int64
+	misses int64
+}
+
+// denial is a cached denied response for a key.
+type denial struct {
+	org   string
+	cost  int
+	until time.Time
+	resp  RateLimitResponse
+}
+
+// DenyCacheStats reports how often the cache answered a check.
+type DenyCacheStats struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+	Entries int     `json:"entries"`
+}
+
+// DenyCacheReporter is implemented by limiters with a deny cache.
+type DenyCacheReporter interface {
+	DenyCacheStats() DenyCacheStats
+}
+
+var (
+	_ ScopedLimiter     = (*DenyCache)(nil)
+	_ BatchLimiter      = (*DenyCache)(nil)
+	_ DenyCacheReporter = (*DenyCache)(nil)
+)
+
+// denyCacheHoldLimiter keeps reservations available when the wrapped
+// limiter supports them. Holds always go to the wrapped limiter.
+type denyCacheHoldLimiter struct {
+	*DenyCache
+	HoldLimiter
+}
+
+// Commit settles the hold and forgets the key's denial, since the units the
+// hold gives back may make room.
+func (c *denyCacheHoldLimiter) Commit(ctx context.Context, key string, holdID string, used int) (int, error) {
+	released, err := c.HoldLimiter.Commit(ctx, key, holdID, used)
+	if err == nil {
+		c.forget(key)
+	}
+	return released, err
+}
+
+// Cancel releases the hold and forgets the key's denial.
+func (c *denyCacheHoldLimiter) Cancel(ctx context.Context, key string, holdID string) (int, error) {
+	released, err := c.HoldLimiter.Cancel(ctx, key, holdID)
+	if err == nil {
+		c.forget(key)
+	}
+	return released, err
+}
+
+// NewDenyCache wraps l with a cache of at most maxEntries denied keys. The
+// result is also a HoldLimiter when l is.
+func NewDenyCache(l Limiter, maxEntries int) Limiter {
+	c := &DenyCache{
+		limiter:    l,
+		maxEntries: maxEntries,
+		entries:    make(map[string]denial),
+	}
+	if hl, ok := l.(HoldLimiter); ok {
+		return &denyCacheHoldLimiter{DenyCache: c, HoldLimiter: hl}
+	}
+	return c
+}
+
+func (c *DenyCache) Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error) {
+	return c.AllowScoped(ctx, Scope{User: key}, requestID, 1)
+}
+
+func (c *DenyCache) AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error) {
+	return c.AllowScoped(ctx, Scope{User: key}, requestID, cost)
+}
+
+func (c *DenyCache) AllowScoped(ctx context.Context, scope Scope, requestID string, cost int) (RateLimitResponse, error) {
+	if err := validateCost(cost); err != nil {
+		return RateLimitResponse{}, err
+	}
+	if resp, ok := c.lookup(scope, requestID, cost, time.Now()); ok {
+		return resp, nil
+	}
+	resp, err := allowScoped(ctx, c.limiter, scope, requestID, cost)
+	if err != nil {
+		return RateLimitResponse{}, err
+	}
+	c.record(scope, cost, resp)
+	return resp, nil
+}
+
+// AllowBatch answers the checks it can from the cache and sends the rest to
+// the wrapped limiter together.
+func (c *DenyCache) AllowBatch(ctx context.Context, checks []Check) []BatchResult {
+	now := time.Now()
+	results := make([]BatchResult, len(checks))
+	var misses []Check
+	var indexes []int
+	for i, check := range checks {
+		if err := validateCost(check.Cost); err != nil {
+			results[i].Err = err
+			continue
+		}
+		scope := Scope{Org: check.Org, User: check.Key}
+		if resp, ok := c.lookup(scope, check.RequestID, check.Cost, now); ok {
+			results[i].Response = resp
+			continue
+		}
+		misses = append(misses, check)
+		indexes = append(indexes, i)
+	}
+	if len(misses) == 0 {
+		return results
+	}
+
+	for i, result := range AllowBatch(ctx, c.limiter, misses) {
+		results[indexes[i]] = result
+		if result.Err == nil {
+			check := misses[i]
+			c.record(Scope{Org: check.Org, User: check.Key}, check.Cost, result.Response)
+		}
+	}
+	return results
+}
+
+// lookup returns the cached denial answering a check of cost units, if any.
+func (c *DenyCache) lookup(scope Scope, requestID string, cost int, now time.Time) (RateLimitResponse, bool) {
+	c.mu.RLock()
+	d, ok := c.entries[scope.User]
+	c.mu.RUnlock()
+
+	if !ok || d.org != scope.Org || cost < d.cost || !now.Before(d.until) {
+		atomic.AddInt64(&c.misses, 1)
+		return RateLimitResponse{}, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+
+	resp := d.resp
+	resp.RequestID = requestID
+	resp.RetryAfterMs = d.until.Sub(now).Milliseconds()
+	return resp, true
+}
+
+// record caches resp if it is a denial with a retry time, and forgets an
+// earlier denial of the key once a check is allowed.
+func (c *DenyCache) record(scope Scope, cost int, resp RateLimitResponse) {
+	if resp.Allowed {
+		c.forget(scope.User)
+		return
+	}
+	if resp.Degraded || resp.RetryAfterMs <= 0 {
+		return
+	}
+
+	now := time.Now()
+	d := denial{
+		org:   scope.Org,
+		cost:  cost,
+		until: now.Add(time.Duration(resp.RetryAfterMs) * time.Millisecond),
+		resp:  resp,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[scope.User]; !ok && len(c.entries) >= c.maxEntries {
+		c.removeExpired(now)
+		if len(c.entries) >= c.maxEntries {
+			return
+		}
+	}
+	c.entries[scope.User] = d
+}
+
+// forget drops the denial of key, if any.
+func (c *DenyCache) forget(key string) {
+	c.mu.RLock()
+	_, ok := c.entries[key]
+	c.mu.RUnlock()
+	if ok {
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+	}
+}
+
+// removeExpired drops denials that have run out. c.mu must be held.
+func (c *DenyCache) removeExpired(now time.Time) {
+	for key, d := range c.entries {
+		if !now.Before(d.until) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// DenyCacheStats returns the hit counts since the cache was created.
+func (c *DenyCache) DenyCacheStats() DenyCacheStats {
+	c.mu.RLock()
+	entries := len(c.entries)
+	c.mu.RUnlock()
+
+	stats := DenyCacheStats{
+		Hits:    atomic.LoadInt64(&c.hits),
+		Misses:  atomic.LoadInt64(&c.misses),
+		Entries: entries,
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+func (c *DenyCache) Peek(ctx context.Context, key string) (RateLimitResponse, error) {
+	return c.limiter.Peek(ctx, key)
+}
+
+func (c *DenyCache) PeekScoped(ctx context.Context, scope Scope) (RateLimitResponse, error) {
+	return peekScoped(ctx, c.limiter, scope)
+}
+
+// Reset clears key in the wrapped limiter and forgets its denial here.
+func (c *DenyCache) Reset(ctx context.Context, key string) error {
+	c.forget(key)
+	return c.limiter.Reset(ctx, key)
+}
+
+func (c *DenyCache) Health(ctx context.Context) error {
+	return c.limiter.Health(ctx)
+}
+
+func (c *DenyCache) CircuitState() string {
+	if r, ok := c.limiter.(CircuitReporter); ok {
+		return r.CircuitState()
+	}
+	return ""
+}
+
+func (c *DenyCache) ShardHealth(ctx context.Context) map[string]string {
+	if r, ok := c.limiter.(ShardReporter); ok {
+		return r.ShardHealth(ctx)
+	}
+	return nil
+}
+
+func (c *DenyCache) Capacity() int {
+	return capacity(c.limiter)
+}
+
+func (c *DenyCache) Close() error {
+	return c.limiter.Close()
+}
@@ -0,0 +1,279 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+)
+
+// Failure policies accepted in config.RateLimitConfig.FailurePolicy.
+const (
+	FailureError  = "error"
+	FailureOpen   = "open"
+	FailureClosed = "closed"
+	FailureLocal  = "local"
+)
+
+// failClosedRetryAfter is the retry hint given while failing closed, since
+// there is no stored state to compute one from.
+const failClosedRetryAfter = time.Second
+
+// FailoverLimiter applies a failure policy when the limiter it wraps cannot
+// reach its store. Every check still goes to the wrapped limiter first, so
+// decisions return to it as soon as the store recovers.
+//
+// With FailureLocal, checks are made against an in-memory limiter with the
+// same rules divided by the node count. The nodes together then admit
+// about the configured limit if load is spread evenly, but each node
+// forgets its usage when the store comes back.
+//
+// Holds are not covered: they are two-phase and cannot be settled against
+// a different store than the one that granted them.
+type FailoverLimiter struct {
+	primary  Limiter
+	fallback Limiter // only with FailureLocal
+	policy   string
+	degraded int32
+}
+
+var (
+	_ ScopedLimiter = (*FailoverLimiter)(nil)
+	_ BatchLimiter  = (*FailoverLimiter)(nil)
+)
+
+// failoverHoldLimiter keeps reservations available when the wrapped
+// limiter supports them.
+type failoverHoldLimiter struct {
+	*FailoverLimiter
+	HoldLimiter
+}
+
+// NewFailoverLimiter wraps primary with cfg.RateLimit.FailurePolicy. The
+// result is also a HoldLimiter when primary is.
+func NewFailoverLimiter(cfg *config.Config, primary Limiter) (Limiter, error) {
+	l := &FailoverLimiter{primary: primary, policy: cfg.RateLimit.FailurePolicy}
+	switch l.policy {
+	case FailureOpen, FailureClosed:
+	case FailureLocal:
+		fallback, err := newLimiter(localConfig(cfg))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create local fallback limiter: %w", err)
+		}
+		l.fallback = fallback
+	default:
+		return nil, fmt.Errorf("unknown failure policy %q", l.policy)
+	}
+
+	if hl, ok := primary.(HoldLimiter); ok {
+		return &failoverHoldLimiter{FailoverLimiter: l, HoldLimiter: hl}, nil
+	}
+	return l, nil
+}
+
+// localConfig returns cfg with an in-memory store and every limit divided
+// among cfg.RateLimit.NodeCount nodes, rounding down but keeping at least
+// one request per node.
+func localConfig(cfg *config.Config) *config.Config {
+	local := *cfg
+	local.Store.Backend = StoreMemory
+
+	nodes := max(cfg.RateLimit.NodeCount, 1)
+	scale := func(limit int) int {
+		if limit <= 0 {
+			return limit
+		}
+		return max(limit/nodes, 1)
+	}
+	rl := &local.RateLimit
+	rl.DefaultLimit = scale(rl.DefaultLimit)
+	rl.Burst = scale(rl.Burst)
+	rl.OrgLimit = scale(rl.OrgLimit)
+	rl.GlobalLimit = scale(rl.GlobalLimit)
+	rl.Limits = make([]config.LimitRule, len(cfg.RateLimit.Limits))
+	for i, r := range cfg.RateLimit.Limits {
+		rl.Limits[i] = config.LimitRule{Limit: scale(r.Limit), Window: r.Window}
+	}
+	rl.KeyLimits = make([]config.LimitRule, len(cfg.RateLimit.KeyLimits))
+	for i, r := range cfg.RateLimit.KeyLimits {
+		rl.KeyLimits[i] = r
+		rl.KeyLimits[i].Limit = scale(r.Limit)
+	}
+	return &local
+}
+
+func (l *FailoverLimiter) Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error) {
+	return l.AllowScoped(ctx, Scope{User: key}, requestID, 1)
+}
+
+func (l *FailoverLimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error) {
+	return l.AllowScoped(ctx, Scope{User: key}, requestID, cost)
+}
+
+func (l *FailoverLimiter) AllowScoped(ctx context.Context, scope Scope, requestID string, cost int) (RateLimitResponse, error) {
+	if err := validateCost(cost); err != nil {
+		return RateLimitResponse{}, err
+	}
+	resp, err := allowScoped(ctx, l.primary, scope, requestID, cost)
+	if err == nil {
+		l.recovered()
+		return resp, nil
+	}
+	return l.degradedAllow(ctx, scope, requestID, cost, err)
+}
+
+// AllowBatch applies the failure policy to each check the wrapped limiter
+// could not make.
+func (l *FailoverLimiter) AllowBatch(ctx context.Context, checks []Check) []BatchResult {
+	results := AllowBatch(ctx, l.primary, checks)
+	for i, c := range checks {
+		if results[i].Err == nil {
+			l.recovered()
+			continue
+		}
+		if validateCost(c.Cost) != nil {
+			continue
+		}
+		scope := Scope{Org: c.Org, User: c.Key}
+		results[i].Response, results[i].Err = l.degradedAllow(ctx, scope, c.RequestID, c.Cost, results[i].Err)
+	}
+	return results
+}
+
+// degradedAllow decides a check by the failure policy after the wrapped
+// limiter failed with err.
+func (l *FailoverLimiter) degradedAllow(ctx context.Context, scope Scope, requestID string, cost int, err error) (RateLimitResponse, error) {
+	l.failed(err)
+
+	var resp RateLimitResponse
+	switch l.policy {
+	case FailureLocal:
+		resp, err = allowScoped(ctx, l.fallback, scope, requestID, cost)
+		if err != nil {
+			return RateLimitResponse{}, err
+		}
+	default:
+		resp = l.policyResponse(scope.User, requestID)
+	}
+	resp.Degraded = true
+	return resp, nil
+}
+
+func (l *FailoverLimiter) Peek(ctx context.Context, key string) (RateLimitResponse, error) {
+	return l.PeekScoped(ctx, Scope{User: key})
+}
+
+func (l *FailoverLimiter) PeekScoped(ctx context.Context, scope Scope) (RateLimitResponse, error) {
+	resp, err := peekScoped(ctx, l.primary, scope)
+	if err == nil {
+		l.recovered()
+		return resp, nil
+	}
+	l.failed(err)
+
+	switch l.policy {
+	case FailureLocal:
+		resp, err = peekScoped(ctx, l.fallback, scope)
+		if err != nil {
+			return RateLimitResponse{}, err
+		}
+	default:
+		resp = l.policyResponse(scope.User, "")
+	}
+	resp.Degraded = true
+	return resp, nil
+}
+
+// policyResponse is the decision of FailureOpen or FailureClosed.
+func (l *FailoverLimiter) policyResponse(key string, requestID string) RateLimitResponse {
+	now := time.Now()
+	resp := RateLimitResponse{
+		Allowed:     l.policy == FailureOpen,
+		ResetTime:   now,
+		WindowStart: now,
+		ClientID:    key,
+		RequestID:   requestID,
+	}
+	if !resp.Allowed {
+		resp.ResetTime = now.Add(failClosedRetryAfter)
+		resp.RetryAfterMs = failClosedRetryAfter.Milliseconds()
+	}
+	return resp
+}
+
+// failed and recovered log when decisions switch between the store and the
+// failure policy.
+func (l *FailoverLimiter) failed(err error) {
+	if atomic.CompareAndSwapInt32(&l.degraded, 0, 1) {
+		log.Printf("Rate limit store unavailable, applying %q failure policy: %v", l.policy, err)
+	}
+}
+
+func (l *FailoverLimiter) recovered() {
+	if atomic.CompareAndSwapInt32(&l.degraded, 1, 0) {
+		log.Printf("Rate limit store recovered")
+	}
+}
+
+// Degraded reports whether the last check fell back to the failure policy.
+func (l *FailoverLimiter) Degraded() bool {
+	return atomic.LoadInt32(&l.degraded) == 1
+}
+
+// Reset clears key in the store and, with FailureLocal, in the fallback.
+func (l *FailoverLimiter) Reset(ctx context.Context, key string) error {
+	if l.fallback != nil {
+		if err := l.fallback.Reset(ctx, key); err != nil {
+			return err
+		}
+	}
+	return l.primary.Reset(ctx, key)
+}
+
+func (l *FailoverLimiter) Health(ctx context.Context) error {
+	return l.primary.Health(ctx)
+}
+
+func (l *FailoverLimiter) CircuitState() string {
+	if c, ok := l.primary.(CircuitReporter); ok {
+		return c.CircuitState()
+	}
+	return ""
+}
+
+func (l *FailoverLimiter) ShardHealth(ctx context.Context) map[string]string {
+	if r, ok := l.primary.(ShardReporter); ok {
+		return r.ShardHealth(ctx)
+	}
+	return nil
+}
+
+func (l *FailoverLimiter) Capacity() int {
+	return capacity(l.primary)
+}
+
+func (l *FailoverLimiter) Close() error {
+	if l.fallback != nil {
+		l.fallback.Close()
+	}
+	return l.primary.Close()
+}
+
+// allowScoped charges scope with l, using only the user key when l is not
+// a ScopedLimiter.
+func allowScoped(ctx context.Context, l Limiter, scope Scope, requestID string, cost int) (RateLimitResponse, error) {
+	if scoped, ok := l.(ScopedLimiter); ok {
+		return scoped.AllowScoped(ctx, scope, requestID, cost)
+	}
+	return l.AllowN(ctx, scope.User, requestID, cost)
+}
+
+func peekScoped(ctx context.Context, l Limiter, scope Scope) (RateLimitResponse, error) {
+	if scoped, ok := l.(ScopedLimiter); ok {
+		return scoped.PeekScoped(ctx, scope)
+	}
+	return l.Peek(ctx, scope.User)
+}
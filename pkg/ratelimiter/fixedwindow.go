@@ -0,0 +1,205 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+)
+
+// A key's fixed window is a hash holding the start of the current window
+// and its count. The script picks the window from its own clock, so with
+// the "redis" time source every node agrees on it, and starts a new one by
+// replacing the hash. Windows are aligned to the Unix epoch.
+//
+// fixedWindowScript charges cost units to the window only when they fit
+// under the limit, so a denied request never touches the counter.
+//
+// KEYS: window hash.
+// ARGV: now (ms), window (ms), cost, limit, expiry slack (ms). A cost of
+// zero only reports the state and writes nothing.
+// Returns {allowed, count, window start (ms), now} where count includes the
+// charged units.
+const fixedWindowScript = clockLua + fixedWindowLua + `
+local now = script_time(ARGV[1], 1000)
+local window = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local start, count, current = fixed_window(KEYS[1], now, window)
+if count + cost > tonumber(ARGV[4]) then
+    return {0, count, start, now}
+end
+if cost > 0 then
+    if not current then
+        redis.call("DEL", KEYS[1])
+        redis.call("HSET", KEYS[1], "start", start)
+    end
+    count = redis.call("HINCRBY", KEYS[1], "count", cost)
+    redis.call("PEXPIRE", KEYS[1], start + window - now + tonumber(ARGV[5]))
+end
+return {1, count, start, now}
+`
+
+// fixedWindowLua defines fixed_window, which returns the start of the
+// window containing now, its count, and whether the hash already holds it.
+const fixedWindowLua = `
+local function fixed_window(key, now, window)
+    local start = now - now % window
+    local state = redis.call("HMGET", key, "start", "count")
+    if tonumber(state[1]) ~= start then
+        return start, 0, false
+    end
+    return start, tonumber(state[2]) or 0, true
+end
+`
+
+const fixedWindowKeyPrefix = "fw:"
+
+// fixedWindowExpirySlack keeps a counter around briefly after its window ends
+// so that a request racing the boundary never recreates an expired key.
+const fixedWindowExpirySlack = 5 * time.Second
+
+var _ Limiter = (*FixedWindowLimiter)(nil)
+
+// FixedWindowLimiter counts requests in windows aligned to wall-clock
+// boundaries, so a per-minute limit resets on the minute and a per-day limit
+// at midnight UTC. Resets are predictable, but a client can spend up to
+// twice the limit across a boundary. Denied requests are not counted.
+type FixedWindowLimiter struct {
+	Store      Store
+	limit      int
+	windowSize time.Duration
+	sha        string
+
+	timing
+}
+
+func NewFixedWindowLimiter(cfg *config.Config, limit int, windowSize time.Duration) (*FixedWindowLimiter, error) {
+	if limit <= 0 || windowSize < time.Second {
+		return nil, fmt.Errorf("invalid fixed window: %d per %v", limit, windowSize)
+	}
+
+	t, err := newTiming(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sha, err := store.ScriptLoad(context.Background(), fixedWindowScript)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load script: %w", err)
+	}
+
+	return &FixedWindowLimiter{
+		Store:      store,
+		timing:     t,
+		limit:      limit,
+		windowSize: windowSize,
+		sha:        sha,
+	}, nil
+}
+
+func fixedWindowKey(key string) string {
+	return fixedWindowKeyPrefix + hashTag(key)
+}
+
+func (l *FixedWindowLimiter) Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error) {
+	return l.AllowN(ctx, key, requestID, 1)
+}
+
+// AllowN charges cost units if they fit in the current window. A denied
+// request is not counted.
+func (l *FixedWindowLimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error) {
+	if err := validateCost(cost); err != nil {
+		return RateLimitResponse{}, err
+	}
+
+	resp, err := l.eval(ctx, key, cost)
+	if err != nil {
+		return RateLimitResponse{}, err
+	}
+	resp.RequestID = requestID
+	return resp, nil
+}
+
+func (l *FixedWindowLimiter) Peek(ctx context.Context, key string) (RateLimitResponse, error) {
+	resp, err := l.eval(ctx, key, 0)
+	if err != nil {
+		return RateLimitResponse{}, err
+	}
+	resp.Allowed = resp.Remaining >= 1
+	return resp, nil
+}
+
+// eval runs fixedWindowScript for cost units of key; zero only reports the
+// state.
+func (l *FixedWindowLimiter) eval(ctx context.Context, key string, cost int) (RateLimitResponse, error) {
+	now := l.scriptTime(l.now().UnixMilli())
+	window := l.windowSize.Milliseconds()
+
+	result, err := l.Store.EvalSha(ctx, l.sha, []string{fixedWindowKey(key)}, now, window, cost, l.limit, fixedWindowExpirySlack.Milliseconds())
+	if err != nil {
+		return RateLimitResponse{}, fmt.Errorf("failed to execute script: %w", err)
+	}
+	vals, err := parseScriptResult(result, 4)
+	if err != nil {
+		return RateLimitResponse{}, err
+	}
+
+	start := time.UnixMilli(vals[2])
+	end := start.Add(l.windowSize)
+	resp := l.response(key, vals[1], start, end)
+	resp.Allowed = vals[0] == 1
+	if !resp.Allowed {
+		resp.RetryAfterMs = end.Sub(time.UnixMilli(vals[3])).Milliseconds()
+	}
+	return resp, nil
+}
+
+func (l *FixedWindowLimiter) response(key string, count int64, start, end time.Time) RateLimitResponse {
+	remaining := l.limit - int(count)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return RateLimitResponse{
+		Remaining:   remaining,
+		ResetTime:   end,
+		WindowStart: start,
+		ClientID:    key,
+	}
+}
+
+func (l *FixedWindowLimiter) Reset(ctx context.Context, key string) error {
+	if err := l.Store.Del(ctx, fixedWindowKey(key)); err != nil {
+		return fmt.Errorf("failed to reset %s: %w", key, err)
+	}
+	return nil
+}
+
+func (l *FixedWindowLimiter) Health(ctx context.Context) error {
+	if err := l.Store.Health(ctx); err != nil {
+		return fmt.Errorf("redis health check failed: %w", err)
+	}
+	return nil
+}
+
+func (l *FixedWindowLimiter) CircuitState() string {
+	return circuitState(l.Store)
+}
+
+func (l *FixedWindowLimiter) ShardHealth(ctx context.Context) map[string]string {
+	return shardHealth(ctx, l.Store)
+}
+
+func (l *FixedWindowLimiter) Capacity() int {
+	return l.limit
+}
+
+func (l *FixedWindowLimiter) Close() error {
+	return l.Store.Close()
+}
@@ -0,0 +1,180 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+)
+
+// GCRA keeps a single theoretical arrival time (TAT) per key. A request is
+// admitted when advancing the TAT by one emission interval keeps it within
+// the tolerance (limit * interval) of now.
+//
+// All times are integer microseconds so that Remaining is exact. The TAT is
+// written with string.format because Redis formats Lua numbers with only 14
+// significant digits.
+//
+// ARGV: now (us), emission interval (us), tolerance (us), quantity.
+// A quantity of zero only reports the state and writes nothing.
+// Returns {allowed, remaining, reset after (ms), retry after (ms), now (us)}.
+const gcraScript = clockLua + `
+local key = KEYS[1]
+local now = script_time(ARGV[1], 1000000)
+local interval = tonumber(ARGV[2])
+local tolerance = tonumber(ARGV[3])
+local quantity = tonumber(ARGV[4])
+
+local tat = tonumber(redis.call("GET", key))
+if tat == nil or tat < now then
+    tat = now
+end
+
+local new_tat = tat + quantity * interval
+local diff = now - (new_tat - tolerance)
+
+if diff < 0 then
+    local remaining = math.floor((now - (tat - tolerance)) / interval)
+    return {0, remaining, math.ceil((tat - now) / 1000), math.ceil(-diff / 1000), now}
+end
+
+if quantity > 0 then
+    redis.call("SET", key, string.format("%d", new_tat), "PX", math.ceil((new_tat - now) / 1000))
+end
+
+return {1, math.floor(diff / interval), math.ceil((new_tat - now) / 1000), 0, now}
+`
+
+const gcraKeyPrefix = "gcra:"
+
+var _ Limiter = (*GCRALimiter)(nil)
+
+// GCRALimiter enforces limit requests per period using the generic cell rate
+// algorithm. It stores one value per key regardless of the limit, where the
+// sliding log stores one sorted set member per admitted request.
+type GCRALimiter struct {
+	Store     Store
+	limit     int
+	period    time.Duration
+	interval  int64 // emission interval in microseconds
+	tolerance int64 // burst tolerance in microseconds
+	sha       string
+
+	timing
+}
+
+func NewGCRALimiter(cfg *config.Config, limit int, period time.Duration) (*GCRALimiter, error) {
+	interval := period.Microseconds() / int64(max(limit, 1))
+	if limit <= 0 || interval <= 0 {
+		return nil, fmt.Errorf("invalid GCRA limit: %d per %v", limit, period)
+	}
+
+	t, err := newTiming(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sha, err := store.ScriptLoad(context.Background(), gcraScript)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load script: %w", err)
+	}
+
+	return &GCRALimiter{
+		Store:     store,
+		timing:    t,
+		limit:     limit,
+		period:    period,
+		interval:  interval,
+		tolerance: interval * int64(limit),
+		sha:       sha,
+	}, nil
+}
+
+func (l *GCRALimiter) Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error) {
+	return l.AllowN(ctx, key, requestID, 1)
+}
+
+func (l *GCRALimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error) {
+	if err := validateCost(cost); err != nil {
+		return RateLimitResponse{}, err
+	}
+	return evalCall(ctx, l.Store, l.allowCall(key, requestID, cost))
+}
+
+func (l *GCRALimiter) AllowBatch(ctx context.Context, checks []Check) []BatchResult {
+	return evalBatch(ctx, l.Store, checks, checkCalls(l.allowCall))
+}
+
+func (l *GCRALimiter) Peek(ctx context.Context, key string) (RateLimitResponse, error) {
+	resp, err := evalCall(ctx, l.Store, l.call(key, 0))
+	if err != nil {
+		return RateLimitResponse{}, err
+	}
+	resp.Allowed = resp.Remaining >= 1
+	return resp, nil
+}
+
+func (l *GCRALimiter) allowCall(key string, requestID string, cost int) scriptCall {
+	return l.call(key, cost).withRequestID(requestID)
+}
+
+// call requests quantity units for key; zero only reports the state.
+func (l *GCRALimiter) call(key string, quantity int) scriptCall {
+	now := l.now().UnixMicro()
+
+	call := newScriptCall("GCRA", l.sha, []string{gcraKeyPrefix + hashTag(key)}, l.scriptTime(now), l.interval, l.tolerance, quantity)
+	call.decode = func(result interface{}) (RateLimitResponse, error) {
+		vals, err := parseScriptResult(result, 5)
+		if err != nil {
+			return RateLimitResponse{}, err
+		}
+		now := time.UnixMicro(vals[4])
+
+		return RateLimitResponse{
+			Allowed:      vals[0] != 0,
+			Remaining:    int(vals[1]),
+			ResetTime:    now.Add(time.Duration(vals[2]) * time.Millisecond),
+			WindowStart:  now.Add(-l.period),
+			RetryAfterMs: vals[3],
+			ClientID:     key,
+		}, nil
+	}
+	return call
+}
+
+func (l *GCRALimiter) Reset(ctx context.Context, key string) error {
+	if err := l.Store.Del(ctx, gcraKeyPrefix+hashTag(key)); err != nil {
+		return fmt.Errorf("failed to reset %s: %w", key, err)
+	}
+	return nil
+}
+
+func (l *GCRALimiter) Health(ctx context.Context) error {
+	if err := l.Store.Health(ctx); err != nil {
+		return fmt.Errorf("redis health check failed: %w", err)
+	}
+	return nil
+}
+
+func (l *GCRALimiter) CircuitState() string {
+	return circuitState(l.Store)
+}
+
+func (l *GCRALimiter) ShardHealth(ctx context.Context) map[string]string {
+	return shardHealth(ctx, l.Store)
+}
+
+func (l *GCRALimiter) Capacity() int {
+	return l.limit
+}
+
+func (l *GCRALimiter) Close() error {
+	return l.Store.Close()
+}
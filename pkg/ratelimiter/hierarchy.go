@@ -0,0 +1,142 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+)
+
+const hierarchyKeyPrefix = "{hl}:"
+
+// Scope names reported in LimitStatus.Name and ViolatedLimit.
+const (
+	ScopeUser   = "user"
+	ScopeOrg    = "org"
+	ScopeGlobal = "global"
+)
+
+// Scope identifies the keys charged by a hierarchical check. Org may be
+// empty for callers that do not belong to an organization.
+type Scope struct {
+	Org  string
+	User string
+}
+
+// ScopedLimiter is implemented by limiters that charge a user together with
+// the organization it belongs to.
+type ScopedLimiter interface {
+	Limiter
+	AllowScoped(ctx context.Context, scope Scope, requestID string, cost int) (RateLimitResponse, error)
+	PeekScoped(ctx context.Context, scope Scope) (RateLimitResponse, error)
+}
+
+var _ ScopedLimiter = (*HierarchicalLimiter)(nil)
+
+// HierarchicalLimiter charges the user, its organization and a service-wide
+// global budget in one atomic check. If any scope would be exceeded nothing
+// is charged, so a user cap never burns the shared org budget on a denial.
+type HierarchicalLimiter struct {
+	*logEvaluator
+	user   Rule
+	org    Rule
+	global Rule
+}
+
+// NewHierarchicalLimiter creates a limiter with the given per-scope rules.
+// A rule with a zero Limit disables that scope; the user rule is required.
+func NewHierarchicalLimiter(cfg *config.Config, user, org, global Rule) (*HierarchicalLimiter, error) {
+	if user.Limit <= 0 || user.Window.Milliseconds() <= 0 {
+		return nil, fmt.Errorf("invalid user rule %s", user.name())
+	}
+	for _, r := range []Rule{org, global} {
+		if r.Limit < 0 || (r.Limit > 0 && r.Window.Milliseconds() <= 0) {
+			return nil, fmt.Errorf("invalid scope rule %s", r.name())
+		}
+	}
+
+	e, err := newLogEvaluator(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Name, org.Name, global.Name = ScopeUser, ScopeOrg, ScopeGlobal
+	return &HierarchicalLimiter{logEvaluator: e, user: user, org: org, global: global}, nil
+}
+
+// Capacity is the strictest limit a check without an org is charged to.
+func (l *HierarchicalLimiter) Capacity() int {
+	return minLimit(l.checks(Scope{}))
+}
+
+// checks returns the sorted sets charged for scope. One script touches the
+// user, org and global sets together, so they share the "{hl}" hash tag and
+// live in a single Redis Cluster slot.
+func (l *HierarchicalLimiter) checks(scope Scope) []logCheck {
+	checks := []logCheck{{key: hierarchyKeyPrefix + "user:" + scope.User, rule: l.user}}
+	if scope.Org != "" && l.org.Limit > 0 {
+		checks = append(checks, logCheck{key: hierarchyKeyPrefix + "org:" + scope.Org, rule: l.org})
+	}
+	if l.global.Limit > 0 {
+		checks = append(checks, logCheck{key: hierarchyKeyPrefix + "global", rule: l.global})
+	}
+	return checks
+}
+
+func (l *HierarchicalLimiter) AllowScoped(ctx context.Context, scope Scope, requestID string, cost int) (RateLimitResponse, error) {
+	if err := validateCost(cost); err != nil {
+		return RateLimitResponse{}, err
+	}
+	return l.eval(ctx, scope.User, l.checks(scope), requestID, cost)
+}
+
+func (l *HierarchicalLimiter) AllowBatch(ctx context.Context, checks []Check) []BatchResult {
+	return evalBatch(ctx, l.Store, checks, func(c Check) (scriptCall, error) {
+		if err := validateCost(c.Cost); err != nil {
+			return scriptCall{}, err
+		}
+		scope := Scope{Org: c.Org, User: c.Key}
+		return l.call(scope.User, l.checks(scope), c.RequestID, c.Cost), nil
+	})
+}
+
+func (l *HierarchicalLimiter) PeekScoped(ctx context.Context, scope Scope) (RateLimitResponse, error) {
+	resp, err := l.eval(ctx, scope.User, l.checks(scope), "", 0)
+	if err != nil {
+		return RateLimitResponse{}, err
+	}
+	resp.Allowed = resp.Remaining >= 1
+	return resp, nil
+}
+
+// Allow checks key as a user without an organization.
+func (l *HierarchicalLimiter) Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error) {
+	return l.AllowScoped(ctx, Scope{User: key}, requestID, 1)
+}
+
+func (l *HierarchicalLimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error) {
+	return l.AllowScoped(ctx, Scope{User: key}, requestID, cost)
+}
+
+func (l *HierarchicalLimiter) Peek(ctx context.Context, key string) (RateLimitResponse, error) {
+	return l.PeekScoped(ctx, Scope{User: key})
+}
+
+// Reset clears the user scope only; org and global budgets are shared.
+func (l *HierarchicalLimiter) Reset(ctx context.Context, key string) error {
+	if err := l.reset(ctx, l.checks(Scope{User: key})[:1]); err != nil {
+		return fmt.Errorf("failed to reset %s: %w", key, err)
+	}
+	return nil
+}
+
+func (l *HierarchicalLimiter) Health(ctx context.Context) error {
+	if err := l.Store.Health(ctx); err != nil {
+		return fmt.Errorf("redis health check failed: %w", err)
+	}
+	return nil
+}
+
+func (l *HierarchicalLimiter) Close() error {
+	return l.Store.Close()
+}
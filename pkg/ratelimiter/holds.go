@@ -0,0 +1,186 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrHoldNotFound is returned when committing or cancelling a hold that does
+// not exist, was already settled, or has expired.
+var ErrHoldNotFound = errors.New("hold not found")
+
+// A hold is a two-phase reservation against the sliding log. While it is
+// open its units are kept out of the log, in a sorted set of hold IDs scored
+// by deadline plus a hash of ID to unit count, and taken off the limit, so
+// they count for as long as the hold lasts however short the window. The
+// units a commit keeps are added to the log as "h:<id>:<n>" members at the
+// time of the commit.
+//
+// holdExpiryLua drops every hold past its deadline and returns the units of
+// the open ones. Scripts that count the log run it first so that abandoned
+// holds stop counting.
+const holdExpiryLua = `
+local function expire_holds(holds, units, now)
+    local expired = redis.call("ZRANGEBYSCORE", holds, 0, now)
+    for _, id in ipairs(expired) do
+        redis.call("HDEL", units, id)
+    end
+    if #expired > 0 then
+        redis.call("ZREMRANGEBYSCORE", holds, 0, now)
+    end
+    local held = 0
+    for _, cost in ipairs(redis.call("HVALS", units)) do
+        held = held + tonumber(cost)
+    end
+    return held
+end
+`
+
+// KEYS: log, holds, hold units.
+// ARGV: op, now (ms), hold ID, then for "reserve": window (ms), limit, cost,
+// timeout (ms); for "commit": units used, window (ms); nothing for "cancel".
+// Reserve returns {allowed, remaining} followed by the log_timing scores and
+// now. Commit and cancel return {found, units released}.
+const holdScript = clockLua + holdExpiryLua + logTimingLua + `
+local log = KEYS[1]
+local holds = KEYS[2]
+local units = KEYS[3]
+local op = ARGV[1]
+local now = script_time(ARGV[2], 1000)
+local id = ARGV[3]
+
+local held = expire_holds(holds, units, now)
+
+if op == "reserve" then
+    local window = tonumber(ARGV[4])
+    local limit = tonumber(ARGV[5]) - held
+    local cost = tonumber(ARGV[6])
+    local timeout = tonumber(ARGV[7])
+    redis.call("ZREMRANGEBYSCORE", log, 0, now - window)
+    local count = redis.call("ZCARD", log)
+    if count + cost > limit then
+        local oldest, freeing = log_timing(log, count, cost, limit)
+        return {0, math.max(0, limit - count), oldest, freeing, now}
+    end
+    redis.call("ZADD", holds, now + timeout, id)
+    redis.call("HSET", units, id, cost)
+    -- The bookkeeping lasts as long as the longest open hold
+    local expiry = math.max(redis.call("PTTL", holds), timeout)
+    redis.call("PEXPIRE", holds, expiry)
+    redis.call("PEXPIRE", units, expiry)
+    local oldest = log_timing(log, count, 0, limit)
+    return {1, limit - count - cost, oldest, -1, now}
+end
+
+local cost = tonumber(redis.call("HGET", units, id))
+if cost == nil then
+    return {0, 0}
+end
+
+local keep = 0
+if op == "commit" then
+    keep = math.min(tonumber(ARGV[4]), cost)
+    for i = 1, keep do
+        redis.call("ZADD", log, now, "h:" .. id .. ":" .. i)
+    end
+    if keep > 0 then
+        redis.call("PEXPIRE", log, math.max(redis.call("PTTL", log), tonumber(ARGV[5]) * 2))
+    end
+end
+redis.call("ZREM", holds, id)
+redis.call("HDEL", units, id)
+return {1, cost - keep}
+`
+
+// Hold is quota set aside by a reserve call. The embedded response reports
+// whether the reservation succeeded; ID is empty when it did not.
+type Hold struct {
+	ID        string    `json:"hold_id,omitempty"`
+	Units     int       `json:"units"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RateLimitResponse
+}
+
+// HoldLimiter is implemented by limiters that support two-phase
+// reserve/commit/cancel of quota.
+type HoldLimiter interface {
+	// Hold reserves cost units for key until timeout. Units of a hold that
+	// is neither committed nor cancelled by then are returned automatically.
+	Hold(ctx context.Context, key string, cost int, timeout time.Duration) (Hold, error)
+	// Commit keeps used units of the hold and returns the rest.
+	Commit(ctx context.Context, key string, holdID string, used int) (released int, err error)
+	// Cancel returns all units of the hold.
+	Cancel(ctx context.Context, key string, holdID string) (released int, err error)
+}
+
+var _ HoldLimiter = (*SlidingWindowLimiter)(nil)
+
+// holdKeys returns the sliding log for key followed by its hold bookkeeping.
+func holdKeys(key string) []string {
+	log := slidingLogKey(key)
+	return []string{log, log + ":holds", log + ":hold-units"}
+}
+
+func (l *SlidingWindowLimiter) Hold(ctx context.Context, key string, cost int, timeout time.Duration) (Hold, error) {
+	if err := validateCost(cost); err != nil {
+		return Hold{}, err
+	}
+	if timeout.Milliseconds() <= 0 {
+		return Hold{}, fmt.Errorf("invalid hold timeout %v", timeout)
+	}
+
+	window := l.windowSize.Milliseconds()
+	id := newRequestID()
+
+	result, err := l.Store.EvalSha(ctx, l.holdSha, holdKeys(key), "reserve", l.scriptTime(l.now().UnixMilli()), id, window, l.limit, cost, timeout.Milliseconds())
+	if err != nil {
+		return Hold{}, fmt.Errorf("failed to execute hold script: %w", err)
+	}
+
+	vals, err := parseScriptResult(result, 5)
+	if err != nil {
+		return Hold{}, err
+	}
+	now := vals[4]
+
+	hold := Hold{
+		Units:             cost,
+		RateLimitResponse: l.response(key, now, vals[0] != 0, int(vals[1]), vals[2], vals[3]),
+	}
+	if hold.Allowed {
+		hold.ID = id
+		hold.ExpiresAt = time.UnixMilli(now + timeout.Milliseconds())
+	}
+	return hold, nil
+}
+
+func (l *SlidingWindowLimiter) Commit(ctx context.Context, key string, holdID string, used int) (int, error) {
+	if used < 0 {
+		return 0, fmt.Errorf("invalid used units %d", used)
+	}
+	return l.settleHold(ctx, key, "commit", holdID, used, l.windowSize.Milliseconds())
+}
+
+func (l *SlidingWindowLimiter) Cancel(ctx context.Context, key string, holdID string) (int, error) {
+	return l.settleHold(ctx, key, "cancel", holdID)
+}
+
+func (l *SlidingWindowLimiter) settleHold(ctx context.Context, key string, op string, holdID string, args ...interface{}) (int, error) {
+	args = append([]interface{}{op, l.scriptTime(l.now().UnixMilli()), holdID}, args...)
+
+	result, err := l.Store.EvalSha(ctx, l.holdSha, holdKeys(key), args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute hold script: %w", err)
+	}
+
+	vals, err := parseScriptResult(result, 2)
+	if err != nil {
+		return 0, err
+	}
+	if vals[0] == 0 {
+		return 0, ErrHoldNotFound
+	}
+	return int(vals[1]), nil
+}
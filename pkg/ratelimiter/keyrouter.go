@@ -0,0 +1,218 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+	"github.com/mshort2/distributed-rate-limiter/pkg/redis"
+)
+
+// ErrHoldsNotSupported is returned by a KeyRouter when the limiter a key is
+// routed to has no reservations.
+var ErrHoldsNotSupported = errors.New("reservations are not supported for this key")
+
+var (
+	_ ScopedLimiter = (*KeyRouter)(nil)
+	_ BatchLimiter  = (*KeyRouter)(nil)
+	_ HoldLimiter   = (*KeyRouter)(nil)
+)
+
+// KeyRouter enforces a different limit and algorithm per group of keys: a
+// key goes to the limiter of the longest config.RateLimitConfig.KeyLimits
+// prefix it starts with, and to the default limiter otherwise. High-volume
+// keys can then use an approximate algorithm while strict keys keep the
+// exact sliding log.
+type KeyRouter struct {
+	routes   []keyRoute // longest prefix first
+	fallback Limiter
+}
+
+type keyRoute struct {
+	prefix  string
+	limiter Limiter
+}
+
+// NewKeyRouter creates a limiter for each of cfg.RateLimit.KeyLimits and
+// sends every other key to fallback. It takes ownership of fallback.
+func NewKeyRouter(cfg *config.Config, fallback Limiter) (*KeyRouter, error) {
+	r := &KeyRouter{fallback: fallback}
+	for _, rule := range cfg.RateLimit.KeyLimits {
+		l, err := NewFromPolicy(cfg, Policy{
+			Algorithm: rule.Algorithm,
+			Limit:     rule.Limit,
+			Window:    rule.Window,
+		})
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("invalid limit for keys %q: %w", rule.KeyPrefix, err)
+		}
+		r.routes = append(r.routes, keyRoute{prefix: rule.KeyPrefix, limiter: l})
+	}
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].prefix) > len(r.routes[j].prefix)
+	})
+	return r, nil
+}
+
+// route returns the limiter for key.
+func (r *KeyRouter) route(key string) Limiter {
+	for _, route := range r.routes {
+		if strings.HasPrefix(key, route.prefix) {
+			return route.limiter
+		}
+	}
+	return r.fallback
+}
+
+// limiters returns the default limiter followed by those of the routes.
+func (r *KeyRouter) limiters() []Limiter {
+	all := []Limiter{r.fallback}
+	for _, route := range r.routes {
+		all = append(all, route.limiter)
+	}
+	return all
+}
+
+func (r *KeyRouter) Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error) {
+	return r.route(key).Allow(ctx, key, requestID)
+}
+
+func (r *KeyRouter) AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error) {
+	return r.route(key).AllowN(ctx, key, requestID, cost)
+}
+
+func (r *KeyRouter) AllowScoped(ctx context.Context, scope Scope, requestID string, cost int) (RateLimitResponse, error) {
+	return allowScoped(ctx, r.route(scope.User), scope, requestID, cost)
+}
+
+// AllowBatch sends the checks of each limiter to it together.
+func (r *KeyRouter) AllowBatch(ctx context.Context, checks []Check) []BatchResult {
+	groups := make(map[Limiter][]int)
+	var order []Limiter
+	for i, c := range checks {
+		l := r.route(c.Key)
+		if _, ok := groups[l]; !ok {
+			order = append(order, l)
+		}
+		groups[l] = append(groups[l], i)
+	}
+
+	results := make([]BatchResult, len(checks))
+	for _, l := range order {
+		indexes := groups[l]
+		group := make([]Check, len(indexes))
+		for i, index := range indexes {
+			group[i] = checks[index]
+		}
+		for i, result := range AllowBatch(ctx, l, group) {
+			results[indexes[i]] = result
+		}
+	}
+	return results
+}
+
+func (r *KeyRouter) Peek(ctx context.Context, key string) (RateLimitResponse, error) {
+	return r.route(key).Peek(ctx, key)
+}
+
+func (r *KeyRouter) PeekScoped(ctx context.Context, scope Scope) (RateLimitResponse, error) {
+	return peekScoped(ctx, r.route(scope.User), scope)
+}
+
+func (r *KeyRouter) Reset(ctx context.Context, key string) error {
+	return r.route(key).Reset(ctx, key)
+}
+
+func (r *KeyRouter) Hold(ctx context.Context, key string, cost int, timeout time.Duration) (Hold, error) {
+	hl, ok := r.route(key).(HoldLimiter)
+	if !ok {
+		return Hold{}, ErrHoldsNotSupported
+	}
+	return hl.Hold(ctx, key, cost, timeout)
+}
+
+func (r *KeyRouter) Commit(ctx context.Context, key string, holdID string, used int) (int, error) {
+	hl, ok := r.route(key).(HoldLimiter)
+	if !ok {
+		return 0, ErrHoldsNotSupported
+	}
+	return hl.Commit(ctx, key, holdID, used)
+}
+
+func (r *KeyRouter) Cancel(ctx context.Context, key string, holdID string) (int, error) {
+	hl, ok := r.route(key).(HoldLimiter)
+	if !ok {
+		return 0, ErrHoldsNotSupported
+	}
+	return hl.Cancel(ctx, key, holdID)
+}
+
+// Capacity is the largest capacity of any route, so that WaitN only fails
+// early for costs no key could be granted. It is 0 when one is unknown.
+func (r *KeyRouter) Capacity() int {
+	largest := 0
+	for _, l := range r.limiters() {
+		c := capacity(l)
+		if c == 0 {
+			return 0
+		}
+		largest = max(largest, c)
+	}
+	return largest
+}
+
+func (r *KeyRouter) Health(ctx context.Context) error {
+	for _, l := range r.limiters() {
+		if err := l.Health(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CircuitState reports the least healthy circuit of the routes, each of
+// which has its own store.
+func (r *KeyRouter) CircuitState() string {
+	state := ""
+	for _, l := range r.limiters() {
+		c, ok := l.(CircuitReporter)
+		if !ok {
+			continue
+		}
+		switch s := c.CircuitState(); s {
+		case redis.CircuitOpen:
+			return s
+		case redis.CircuitHalfOpen:
+			state = s
+		case redis.CircuitClosed:
+			if state == "" {
+				state = s
+			}
+		}
+	}
+	return state
+}
+
+// ShardHealth reports the shards of the default limiter. Every route uses
+// the same store configuration and so the same shards.
+func (r *KeyRouter) ShardHealth(ctx context.Context) map[string]string {
+	if s, ok := r.fallback.(ShardReporter); ok {
+		return s.ShardHealth(ctx)
+	}
+	return nil
+}
+
+func (r *KeyRouter) Close() error {
+	var first error
+	for _, l := range r.limiters() {
+		if err := l.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,19 @@
+package limiter
+
+// Redis Cluster only runs a script when all of its keys hash to one slot,
+// and it hashes only the part of a key inside the first {...}. Every key a
+// limiter derives from a client key therefore starts with the same
+// "<prefix>:{<client key>}" so that multi-key scripts and deletes stay in
+// one slot. Hierarchical checks span clients and use one fixed tag instead.
+// Single-node deployments are unaffected.
+
+// hashTag wraps key in braces so that keys built from it share a slot.
+func hashTag(key string) string {
+	return "{" + key + "}"
+}
+
+const slidingLogKeyPrefix = "sl:"
+
+func slidingLogKey(key string) string {
+	return slidingLogKeyPrefix + hashTag(key)
+}
@@ -0,0 +1,311 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+)
+
+// leaseScript takes up to size units from the current fixed window, or
+// none when fewer than min remain. Each window also has a generation, set
+// by the first lease after the window starts or is reset, so that units are
+// only given back to the window they came from.
+//
+// KEYS: window hash.
+// ARGV: now (ms), window (ms), size, min, limit, expiry slack (ms),
+// generation for a new window.
+// Returns {granted, count, window start (ms), now, generation} where count
+// includes the granted units.
+const leaseScript = clockLua + fixedWindowLua + `
+local now = script_time(ARGV[1], 1000)
+local window = tonumber(ARGV[2])
+local start, count, current = fixed_window(KEYS[1], now, window)
+local generation = redis.call("HGET", KEYS[1], "gen")
+if not current then
+    redis.call("DEL", KEYS[1])
+    generation = false
+end
+if not generation then
+    generation = ARGV[7]
+    redis.call("HSET", KEYS[1], "start", start, "gen", generation)
+end
+local granted = math.min(tonumber(ARGV[3]), tonumber(ARGV[5]) - count)
+if granted >= tonumber(ARGV[4]) then
+    count = redis.call("HINCRBY", KEYS[1], "count", granted)
+else
+    granted = 0
+end
+redis.call("PEXPIRE", KEYS[1], start + window - now + tonumber(ARGV[6]))
+return {granted, count, start, now, tonumber(generation)}
+`
+
+// releaseScript gives unspent leased units back to their window. It does
+// nothing when the window has ended or is of another generation because it
+// was reset, and never takes the count below zero.
+//
+// KEYS: window hash.
+// ARGV: units, window start (ms), generation of the lease.
+// Returns the units given back.
+const releaseScript = `
+local state = redis.call("HMGET", KEYS[1], "start", "count", "gen")
+if tonumber(state[1]) ~= tonumber(ARGV[2]) or state[3] ~= ARGV[3] then
+    return 0
+end
+local units = math.min(tonumber(ARGV[1]), tonumber(state[2]) or 0)
+if units > 0 then
+    redis.call("HINCRBY", KEYS[1], "count", -units)
+end
+return units
+`
+
+var _ Limiter = (*LeasingLimiter)(nil)
+
+// LeasingLimiter enforces a fixed window limit on the same counters as
+// FixedWindowLimiter, but instead of charging the counter on every request
+// each node leases units from it in batches of leaseSize and admits
+// requests from its lease in memory. A lease is given back when it runs
+// out, after leaseTTL, or on Close, so a hot key costs one round trip per
+// lease rather than one per request.
+//
+// Accuracy: units are taken from the counter before they are spent, so all
+// nodes together never admit more than the limit in a window, just as with
+// FixedWindowLimiter (which allows up to twice the limit across a window
+// boundary). The error is on the side of denying: units leased by one node
+// cannot be spent by another, so a node may deny while up to leaseSize
+// unspent units per other node remain, until those leases are given back
+// within leaseTTL. A node that stops without Close strands its lease until
+// the window ends. Peek counts leased units as used, and Reset only drops
+// this node's lease. Units leased before a Reset on another node are never
+// given back to the counter that replaces it.
+type LeasingLimiter struct {
+	*FixedWindowLimiter
+	leaseSize  int
+	leaseTTL   time.Duration
+	leaseSha   string
+	releaseSha string
+
+	mu     sync.Mutex
+	leases map[string]*lease
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// lease holds the units one node has taken from a window counter. The
+// window's bounds are in script time, and end is also converted to this
+// node's clock so that the lease can tell when its window is over.
+type lease struct {
+	mu         sync.Mutex
+	start      time.Time // of the window the units belong to
+	end        time.Time
+	localEnd   time.Time
+	expires    time.Time
+	units      int   // leased and not yet spent
+	count      int64 // of the counter when the units were leased
+	generation int64 // of the window the units were leased from
+	// dropped is set once the lease is removed from the limiter, so that a
+	// caller waiting on mu looks it up again.
+	dropped bool
+}
+
+func NewLeasingLimiter(cfg *config.Config, limit int, windowSize time.Duration) (*LeasingLimiter, error) {
+	if cfg.RateLimit.LeaseSize <= 0 || cfg.RateLimit.LeaseTTL <= 0 {
+		return nil, fmt.Errorf("invalid lease: %d units for %v", cfg.RateLimit.LeaseSize, cfg.RateLimit.LeaseTTL)
+	}
+
+	fw, err := NewFixedWindowLimiter(cfg, limit, windowSize)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseSha, err := fw.Store.ScriptLoad(context.Background(), leaseScript)
+	if err != nil {
+		fw.Close()
+		return nil, fmt.Errorf("failed to load lease script: %w", err)
+	}
+	releaseSha, err := fw.Store.ScriptLoad(context.Background(), releaseScript)
+	if err != nil {
+		fw.Close()
+		return nil, fmt.Errorf("failed to load release script: %w", err)
+	}
+
+	l := &LeasingLimiter{
+		FixedWindowLimiter: fw,
+		leaseSize:          cfg.RateLimit.LeaseSize,
+		leaseTTL:           cfg.RateLimit.LeaseTTL,
+		leaseSha:           leaseSha,
+		releaseSha:         releaseSha,
+		leases:             make(map[string]*lease),
+		stop:               make(chan struct{}),
+	}
+	go l.expireLeases()
+	return l, nil
+}
+
+func (l *LeasingLimiter) Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error) {
+	return l.AllowN(ctx, key, requestID, 1)
+}
+
+// AllowN spends cost units of the key's lease, leasing more when the lease
+// is short, expired or from an earlier window. Callers for the same key
+// wait for each other, so a hot key has at most one lease request in
+// flight per node.
+func (l *LeasingLimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error) {
+	if err := validateCost(cost); err != nil {
+		return RateLimitResponse{}, err
+	}
+
+	le := l.lockLease(key)
+	defer le.mu.Unlock()
+
+	now := l.now()
+	if !now.Before(le.localEnd) || !now.Before(le.expires) || le.units < cost {
+		if err := l.renew(ctx, le, key, now, cost); err != nil {
+			return RateLimitResponse{}, err
+		}
+	}
+
+	allowed := le.units >= cost
+	if allowed {
+		le.units -= cost
+	}
+
+	resp := l.response(key, le.count-int64(le.units), le.start, le.end)
+	resp.Allowed = allowed
+	resp.RequestID = requestID
+	if !allowed {
+		resp.RetryAfterMs = le.localEnd.Sub(now).Milliseconds()
+	}
+	return resp, nil
+}
+
+// lockLease returns the key's lease, creating it if needed, with its mutex
+// held.
+func (l *LeasingLimiter) lockLease(key string) *lease {
+	for {
+		l.mu.Lock()
+		le, ok := l.leases[key]
+		if !ok {
+			le = &lease{}
+			l.leases[key] = le
+		}
+		l.mu.Unlock()
+
+		le.mu.Lock()
+		if !le.dropped {
+			return le
+		}
+		le.mu.Unlock()
+	}
+}
+
+// renew gives back what is left of le and leases at least cost units of
+// key from the current window. le is left empty when fewer remain.
+func (l *LeasingLimiter) renew(ctx context.Context, le *lease, key string, now time.Time, cost int) error {
+	if err := l.release(ctx, key, le, now); err != nil {
+		return err
+	}
+
+	size := max(l.leaseSize, cost)
+	// Generations stay below 2^53 so that Lua numbers hold them exactly
+	generation := rand.Int64N(1 << 52)
+	result, err := l.Store.EvalSha(ctx, l.leaseSha, []string{fixedWindowKey(key)},
+		l.scriptTime(now.UnixMilli()), l.windowSize.Milliseconds(), size, cost, l.limit, fixedWindowExpirySlack.Milliseconds(), generation)
+	if err != nil {
+		return fmt.Errorf("failed to execute lease script: %w", err)
+	}
+	vals, err := parseScriptResult(result, 5)
+	if err != nil {
+		return err
+	}
+
+	le.start = time.UnixMilli(vals[2])
+	le.end = le.start.Add(l.windowSize)
+	le.localEnd = now.Add(le.end.Sub(time.UnixMilli(vals[3])))
+	le.expires = now.Add(l.leaseTTL)
+	le.units, le.count, le.generation = int(vals[0]), vals[1], vals[4]
+	return nil
+}
+
+// release gives the unspent units of key's lease le back to their window.
+// Units of a window that has ended or been reset are simply dropped.
+func (l *LeasingLimiter) release(ctx context.Context, key string, le *lease, now time.Time) error {
+	units := le.units
+	le.units = 0
+	if units == 0 || !now.Before(le.localEnd) {
+		return nil
+	}
+	if _, err := l.Store.EvalSha(ctx, l.releaseSha, []string{fixedWindowKey(key)}, units, le.start.UnixMilli(), le.generation); err != nil {
+		return fmt.Errorf("failed to release leased units: %w", err)
+	}
+	return nil
+}
+
+// expireLeases gives back expired leases every leaseTTL, so that keys that
+// have gone quiet do not hold on to their units.
+func (l *LeasingLimiter) expireLeases() {
+	ticker := time.NewTicker(l.leaseTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.dropLeases(context.Background(), false)
+		}
+	}
+}
+
+// dropLeases releases and removes the leases that have expired, or all of
+// them when all is set.
+func (l *LeasingLimiter) dropLeases(ctx context.Context, all bool) {
+	l.mu.Lock()
+	leases := make(map[string]*lease, len(l.leases))
+	for key, le := range l.leases {
+		leases[key] = le
+	}
+	l.mu.Unlock()
+
+	now := l.now()
+	for key, le := range leases {
+		le.mu.Lock()
+		if all || !now.Before(le.expires) {
+			if err := l.release(ctx, key, le, now); err != nil {
+				log.Printf("Failed to release lease for %s: %v", key, err)
+			}
+			le.dropped = true
+			l.mu.Lock()
+			delete(l.leases, key)
+			l.mu.Unlock()
+		}
+		le.mu.Unlock()
+	}
+}
+
+// Reset clears the key's window and drops this node's lease on it. Other
+// nodes keep spending their leases until they run out or expire.
+func (l *LeasingLimiter) Reset(ctx context.Context, key string) error {
+	le := l.lockLease(key)
+	le.units = 0
+	le.dropped = true
+	l.mu.Lock()
+	delete(l.leases, key)
+	l.mu.Unlock()
+	le.mu.Unlock()
+
+	return l.FixedWindowLimiter.Reset(ctx, key)
+}
+
+// Close gives back every lease before closing the store.
+func (l *LeasingLimiter) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.stop)
+		l.dropLeases(context.Background(), true)
+	})
+	return l.FixedWindowLimiter.Close()
+}
@@ -3,8 +3,8 @@ package limiter
 import (
 	"context"
     "fmt"
+	"strconv"
 	"time"
-	"github.com/mshort2/distributed-rate-limiter/pkg/redis"
 	"github.com/mshort2/distributed-rate-limiter/internal/config"
 )
 
@@ -13,91 +13,407 @@ type RateLimitResponse struct {
     Remaining   int    `json:"remaining"`
     ResetTime   time.Time  `json:"reset_time"`
 	WindowStart time.Time `json:"window_start"`
+	// RetryAfterMs is how long a denied client should wait before retrying.
+	RetryAfterMs int64  `json:"retry_after_ms"`
     ClientID    string `json:"client_id"`
     Region      string `json:"region"`
     RequestID   string `json:"request_id"`
+	// Duplicate reports that requestID was already admitted in the window.
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Degraded reports that the store was unreachable and the decision was
+	// made by the failure policy instead.
+	Degraded bool `json:"degraded,omitempty"`
+	// ViolatedLimit and Limits are only set by limiters enforcing several
+	// rules at once.
+	ViolatedLimit string        `json:"violated_limit,omitempty"`
+	Limits        []LimitStatus `json:"limits,omitempty"`
 }
 
+// Limiter is implemented by every rate limiting algorithm and backend so
+// that callers such as the HTTP server do not depend on a concrete type.
+type Limiter interface {
+	// Allow records a request for key and reports whether it is permitted.
+	// Sliding log limiters treat a repeated non-empty requestID within the
+	// window as a retry and return the earlier admission without charging.
+	Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error)
+	// AllowN is like Allow but consumes cost units. Either all units are
+	// consumed or, when the request is denied, none are.
+	AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error)
+	// Peek reports the current state for key without consuming quota.
+	Peek(ctx context.Context, key string) (RateLimitResponse, error)
+	// Reset clears all recorded usage for key.
+	Reset(ctx context.Context, key string) error
+	Health(ctx context.Context) error
+	Close() error
+}
+
+// Algorithm names accepted in config.RateLimitConfig.Algorithm.
+const (
+	AlgorithmSlidingLog    = "sliding_log"
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmFixedWindow   = "fixed_window"
+	AlgorithmTokenBucket   = "token_bucket"
+	AlgorithmGCRA          = "gcra"
+)
+
+// Policy describes a single limit and the algorithm that enforces it, so
+// that different limits in one deployment can use different algorithms.
+type Policy struct {
+	Algorithm string
+	Limit     int
+	Window    time.Duration
+	// Burst is the token bucket capacity; zero means Limit.
+	Burst int
+}
+
+// New creates the limiter for the configured default policy, a
+// HierarchicalLimiter when org or global limits are configured, a
+// MultiLimiter when several limits are configured, or a LeasingLimiter when
+// a lease size is configured, behind a KeyRouter when key limits are
+// configured. Unless the failure policy is FailureError it
+// is wrapped to apply that policy, and then in a DenyCache when a deny
+// cache size is configured.
+func New(cfg *config.Config) (Limiter, error) {
+	l, err := newLimiter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.RateLimit.FailurePolicy {
+	case FailureError, "":
+	default:
+		fl, err := NewFailoverLimiter(cfg, l)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l = fl
+	}
+	if cfg.RateLimit.DenyCacheSize > 0 {
+		l = NewDenyCache(l, cfg.RateLimit.DenyCacheSize)
+	}
+	return l, nil
+}
+
+func newLimiter(cfg *config.Config) (Limiter, error) {
+	l, err := newDefaultLimiter(cfg)
+	if err != nil || len(cfg.RateLimit.KeyLimits) == 0 {
+		return l, err
+	}
+	r, err := NewKeyRouter(cfg, l)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// newDefaultLimiter creates the limiter for keys without a key limit.
+func newDefaultLimiter(cfg *config.Config) (Limiter, error) {
+	rl := cfg.RateLimit
+	if rl.OrgLimit > 0 || rl.GlobalLimit > 0 {
+		return NewHierarchicalLimiter(cfg,
+			Rule{Limit: rl.DefaultLimit, Window: rl.DefaultWindow},
+			Rule{Limit: rl.OrgLimit, Window: rl.OrgWindow},
+			Rule{Limit: rl.GlobalLimit, Window: rl.GlobalWindow},
+		)
+	}
+	if len(cfg.RateLimit.Limits) > 0 {
+		rules := make([]Rule, len(cfg.RateLimit.Limits))
+		for i, l := range cfg.RateLimit.Limits {
+			rules[i] = Rule{Limit: l.Limit, Window: l.Window}
+		}
+		return NewMultiLimiter(cfg, rules...)
+	}
+	if rl.LeaseSize > 0 {
+		return NewLeasingLimiter(cfg, rl.DefaultLimit, rl.DefaultWindow)
+	}
+	return NewFromPolicy(cfg, Policy{
+		Algorithm: cfg.RateLimit.Algorithm,
+		Limit:     cfg.RateLimit.DefaultLimit,
+		Window:    cfg.RateLimit.DefaultWindow,
+		Burst:     cfg.RateLimit.Burst,
+	})
+}
+
+// NewFromPolicy creates the limiter selected by p.Algorithm.
+func NewFromPolicy(cfg *config.Config, p Policy) (Limiter, error) {
+	switch p.Algorithm {
+	case AlgorithmSlidingLog, "":
+		return NewRateLimiter(cfg, p.Limit, p.Window)
+	case AlgorithmSlidingWindow:
+		return NewSlidingWindowCounterLimiter(cfg, p.Limit, p.Window)
+	case AlgorithmFixedWindow:
+		return NewFixedWindowLimiter(cfg, p.Limit, p.Window)
+	case AlgorithmTokenBucket:
+		burst := p.Burst
+		if burst == 0 {
+			burst = p.Limit
+		}
+		return NewTokenBucketLimiter(cfg, float64(p.Limit)/p.Window.Seconds(), burst)
+	case AlgorithmGCRA:
+		return NewGCRALimiter(cfg, p.Limit, p.Window)
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", p.Algorithm)
+	}
+}
+
+var _ Limiter = (*SlidingWindowLimiter)(nil)
+
 type SlidingWindowLimiter struct {
-	RedisDB   *redis.Client
+	Store     Store
 	limit     int
 	windowSize time.Duration
 	sha       string
+	holdSha   string
+	// coalescer, when set, pipelines concurrent Allow calls.
+	coalescer *coalescer
+
+	timing
 }
 
-func NewRateLimiter(cfg *config.Config, limit int, windowSize time.Duration) (*SlidingWindowLimiter, error) {
-    // Lua script for atomic sliding log rate limiting
-    lua := `
+// logTimingLua finds when the sliding log frees up. It returns the score of
+// the oldest entry and, when count + cost exceeds limit, the score of the
+// entry whose expiry makes room for cost units; -1 where there is none.
+const logTimingLua = `
+local function log_timing(log, count, cost, limit)
+    local oldest, freeing = -1, -1
+    local first = redis.call("ZRANGE", log, 0, 0, "WITHSCORES")
+    if #first > 0 then
+        oldest = tonumber(first[2])
+    end
+    local excess = count + cost - limit
+    if excess > 0 and count > 0 then
+        local index = math.min(excess, count) - 1
+        local entry = redis.call("ZRANGE", log, index, index, "WITHSCORES")
+        freeing = tonumber(entry[2])
+    end
+    return oldest, freeing
+end
+`
+
+// slidingLogScript admits a request if the log has room for cost more
+// entries after dropping those older than the window and expired holds.
+//
+// KEYS: log, holds, hold units.
+// ARGV: now (ms), window (ms), limit, member, cost, idempotent (1 or 0).
+// A cost of zero charges nothing and reports whether one more unit fits.
+// Returns {allowed, remaining} followed by the log_timing scores, duplicate
+// and now.
+const slidingLogScript = clockLua + holdExpiryLua + logTimingLua + `
     local key = KEYS[1]
-    local now = tonumber(ARGV[1])
+    local now = script_time(ARGV[1], 1000)
     local window = tonumber(ARGV[2])
-    local limit = tonumber(ARGV[3])
-	local member = now .. "-" .. ARGV[4]
+	-- Open holds take their units off the limit
+	local limit = tonumber(ARGV[3]) - expire_holds(KEYS[2], KEYS[3], now)
+	local member = ARGV[4]
+	local cost = tonumber(ARGV[5])
     redis.call("ZREMRANGEBYSCORE", key, 0, now - window)
     local count = redis.call("ZCARD", key)
-    if count >= limit then
-        return {0, limit - count}
+	if cost == 0 then
+		local oldest, freeing = log_timing(key, count, 1, limit)
+		local allowed = 0
+		if count < limit then
+			allowed = 1
+		end
+		return {allowed, math.max(0, limit - count), oldest, freeing, 0, now}
+	end
+	-- A retry of an admitted request finds its first unit still in the window
+	if ARGV[6] == "1" and redis.call("ZSCORE", key, member .. ":1") then
+		local oldest = log_timing(key, count, 0, limit)
+		return {1, math.max(0, limit - count), oldest, -1, 1, now}
+	end
+    if count + cost > limit then
+		local oldest, freeing = log_timing(key, count, cost, limit)
+        return {0, math.max(0, limit - count), oldest, freeing, 0, now}
     end
-    redis.call("ZADD", key, now, member)
+	-- Each unit is its own member so that units age out of the window together
+	for i = 1, cost do
+		redis.call("ZADD", key, now, member .. ":" .. i)
+	end
     redis.call("EXPIRE", key, math.ceil(window / 1000) * 2)
 	count = redis.call("ZCARD", key)
-    return {1, limit - count}
+	local oldest = log_timing(key, count, 0, limit)
+    return {1, limit - count, oldest, -1, 0, now}
     `
 
-	client, err := redis.NewClient(cfg)
+func NewRateLimiter(cfg *config.Config, limit int, windowSize time.Duration) (*SlidingWindowLimiter, error) {
+	t, err := newTiming(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+		return nil, err
 	}
 
-	sha, err := client.ScriptLoad(context.Background(), lua)
+	store, err := newStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sha, err := store.ScriptLoad(context.Background(), slidingLogScript)
 	if err != nil {
 		return &SlidingWindowLimiter{}, fmt.Errorf("failed to load script: %w", err)
 	}
 
-    return &SlidingWindowLimiter{
-        RedisDB:   client,
+	holdSha, err := store.ScriptLoad(context.Background(), holdScript)
+	if err != nil {
+		return &SlidingWindowLimiter{}, fmt.Errorf("failed to load hold script: %w", err)
+	}
+
+    l := &SlidingWindowLimiter{
+        Store:     store,
+        timing:    t,
         limit:     limit,
         windowSize: windowSize,
         sha:       sha,
-    }, nil
+        holdSha:   holdSha,
+    }
+	if cfg.RateLimit.CoalesceWindow > 0 {
+		l.coalescer = newCoalescer(store, cfg.RateLimit.CoalesceWindow)
+	}
+	return l, nil
 
 }
 
 func (l *SlidingWindowLimiter) Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error) {
-	now := time.Now().UnixMilli()
+	return l.AllowN(ctx, key, requestID, 1)
+}
+
+func (l *SlidingWindowLimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error) {
+	if err := validateCost(cost); err != nil {
+		return RateLimitResponse{}, err
+	}
+	call := l.allowCall(key, requestID, cost)
+	if l.coalescer != nil {
+		return l.coalescer.eval(ctx, call)
+	}
+	return evalCall(ctx, l.Store, call)
+}
+
+func (l *SlidingWindowLimiter) AllowBatch(ctx context.Context, checks []Check) []BatchResult {
+	return evalBatch(ctx, l.Store, checks, checkCalls(l.allowCall))
+}
+
+func (l *SlidingWindowLimiter) allowCall(key string, requestID string, cost int) scriptCall {
+	now := l.now().UnixMilli()
 	window := int64(l.windowSize.Milliseconds())
 	limit := int64(l.limit)
 
-	// Execute the Lua script atomically
-	result, err := l.RedisDB.EvalSha(ctx, l.sha, []string{key}, now, window, limit, requestID)
-	if err != nil {
-		return RateLimitResponse{}, fmt.Errorf("failed to execute rate limit script: %w", err)
-	}
+	member, idempotent := logMember(now, key, requestID)
+	call := newScriptCall("rate limit", l.sha, holdKeys(key), l.scriptTime(now), window, limit, member, cost, idempotent)
+	call.decode = func(result interface{}) (RateLimitResponse, error) {
+		vals, err := parseScriptResult(result, 6)
+		if err != nil {
+			return RateLimitResponse{}, err
+		}
 
-	vals, ok := result.([]interface{})
-	if !ok || len(vals) != 2 {
-		return RateLimitResponse{}, fmt.Errorf("unexpected script result: %#v", result)
+		// The script reports the time it used, which is the server's with
+		// TimeRedis
+		resp := l.response(key, vals[5], vals[0] != 0, int(vals[1]), vals[2], vals[3])
+		resp.RequestID = requestID
+		resp.Duplicate = vals[4] != 0
+		return resp, nil
 	}
+	return call
+}
 
-	allowed := vals[0].(int64) != 0
-	remaining := int(vals[1].(int64))
+// response builds the result of a sliding log check. The window next frees
+// up when its oldest entry expires; a denied request can retry once the
+// entry making room for its cost has expired. Scores are -1 when absent.
+func (l *SlidingWindowLimiter) response(key string, now int64, allowed bool, remaining int, oldest, freeing int64) RateLimitResponse {
+	window := l.windowSize.Milliseconds()
 
-	resetTime := time.UnixMilli(now + window)
-	windowStart := time.UnixMilli(now - window)
+	resetTime := time.UnixMilli(now)
+	if oldest >= 0 {
+		resetTime = time.UnixMilli(oldest + window)
+	}
+
+	var retryAfter int64
+	if !allowed {
+		retryAfter = window
+		if freeing >= 0 {
+			retryAfter = max(freeing+window-now, 0)
+		}
+	}
 
 	return RateLimitResponse{
-		Allowed:     allowed,
-		Remaining:   remaining,
-		ResetTime:   resetTime,
-		WindowStart: windowStart,
-		ClientID:    key,
-		RequestID:   requestID,
-	}, nil
+		Allowed:      allowed,
+		Remaining:    remaining,
+		ResetTime:    resetTime,
+		WindowStart:  time.UnixMilli(now - window),
+		RetryAfterMs: retryAfter,
+		ClientID:     key,
+	}
 }
 
 func (l *SlidingWindowLimiter) Health(ctx context.Context) error {
-	if err := l.RedisDB.Health(ctx); err != nil {
+	if err := l.Store.Health(ctx); err != nil {
 		return fmt.Errorf("redis health check failed: %w", err)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// Peek runs the script with a cost of zero, so that the window is placed by
+// the same clock as checks and expired holds are returned first.
+func (l *SlidingWindowLimiter) Peek(ctx context.Context, key string) (RateLimitResponse, error) {
+	return evalCall(ctx, l.Store, l.allowCall(key, "", 0))
+}
+
+func (l *SlidingWindowLimiter) Reset(ctx context.Context, key string) error {
+	if err := l.Store.Del(ctx, holdKeys(key)...); err != nil {
+		return fmt.Errorf("failed to reset %s: %w", key, err)
+	}
+	return nil
+}
+
+func (l *SlidingWindowLimiter) CircuitState() string {
+	return circuitState(l.Store)
+}
+
+func (l *SlidingWindowLimiter) ShardHealth(ctx context.Context) map[string]string {
+	return shardHealth(ctx, l.Store)
+}
+
+func (l *SlidingWindowLimiter) Capacity() int {
+	return l.limit
+}
+
+func (l *SlidingWindowLimiter) Close() error {
+	if l.coalescer != nil {
+		l.coalescer.flush()
+	}
+	return l.Store.Close()
+}
+
+// logMember returns the sliding log member prefix for a request by key and
+// whether the check is idempotent. Requests with an ID use it so that a retry
+// can find its earlier units; anonymous ones get a unique member instead.
+// The key is part of the member because org and global logs are shared by
+// many keys, which may send the same request ID. Its length keeps keys and
+// IDs containing ":" from running together.
+func logMember(now int64, key, requestID string) (string, int) {
+	if requestID != "" {
+		return "r:" + strconv.Itoa(len(key)) + ":" + key + ":" + requestID, 1
+	}
+	return fmt.Sprintf("%d-%s", now, newRequestID()), 0
+}
+
+// validateCost rejects costs that cannot be charged.
+func validateCost(cost int) error {
+	if cost < 1 {
+		return fmt.Errorf("invalid cost %d: must be at least 1", cost)
+	}
+	return nil
+}
+
+// parseScriptResult converts a Lua script reply into n integers. Lua numbers
+// are truncated to integers by Redis, so scripts return whole values only.
+func parseScriptResult(result interface{}, n int) ([]int64, error) {
+	vals, ok := result.([]interface{})
+	if !ok || len(vals) != n {
+		return nil, fmt.Errorf("unexpected script result: %#v", result)
+	}
+	out := make([]int64, n)
+	for i, v := range vals {
+		if out[i], ok = v.(int64); !ok {
+			return nil, fmt.Errorf("unexpected script result: %#v", result)
+		}
+	}
+	return out, nil
+}
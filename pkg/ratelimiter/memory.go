@@ -0,0 +1,561 @@
+package limiter
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/pkg/redis"
+)
+
+// MemoryStore keeps limiter state in process memory, for single-node
+// deployments, local development and tests that should not need Redis.
+//
+// Keys are spread over shards that are locked independently. A script locks
+// the shards of all of its keys for its whole run, so it is as atomic as a
+// Lua script in Redis. Keys expire like Redis keys: lazily when they are
+// accessed, and in the background every cleanup interval so that idle keys
+// do not accumulate.
+type MemoryStore struct {
+	shards []*memoryShard
+
+	mu      sync.RWMutex
+	scripts map[string]memoryScript // by SHA
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type memoryShard struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+// memoryEntry holds a *memoryZSet, a memoryHash or an int64 counter.
+// expiresAt is in Unix milliseconds; zero means the key does not expire.
+type memoryEntry struct {
+	value     interface{}
+	expiresAt int64
+}
+
+func (e *memoryEntry) expired(now int64) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now
+}
+
+// NewMemoryStore creates a store with the given number of shards that
+// removes expired keys every cleanupInterval; zero disables the background
+// cleanup. Close stops it.
+func NewMemoryStore(shards int, cleanupInterval time.Duration) *MemoryStore {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &MemoryStore{
+		shards:  make([]*memoryShard, shards),
+		scripts: make(map[string]memoryScript),
+		stop:    make(chan struct{}),
+	}
+	for i := range s.shards {
+		s.shards[i] = &memoryShard{entries: make(map[string]*memoryEntry)}
+	}
+	if cleanupInterval > 0 {
+		go s.cleanup(cleanupInterval)
+	}
+	return s
+}
+
+func (s *MemoryStore) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.removeExpired(time.Now().UnixMilli())
+		}
+	}
+}
+
+func (s *MemoryStore) removeExpired(now int64) {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		for key, e := range shard.entries {
+			if e.expired(now) {
+				delete(shard.entries, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+func (s *MemoryStore) shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// run calls fn with the shards of keys locked. Like a Redis script, fn may
+// only touch the keys it declared.
+func (s *MemoryStore) run(keys []string, fn func(tx *memoryTx) interface{}) (interface{}, error) {
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		indexes[i] = s.shardIndex(key)
+	}
+	// Lock in shard order so that scripts sharing shards cannot deadlock.
+	sort.Ints(indexes)
+	locked := make(map[int]bool, len(indexes))
+	for _, i := range indexes {
+		if !locked[i] {
+			s.shards[i].mu.Lock()
+			defer s.shards[i].mu.Unlock()
+			locked[i] = true
+		}
+	}
+
+	tx := &memoryTx{store: s, locked: locked, now: time.Now().UnixMilli()}
+	result := fn(tx)
+	// Redis deletes sorted sets and hashes once they are empty.
+	for _, key := range keys {
+		if e := tx.entry(key); e != nil && memoryEmpty(e.value) {
+			tx.del(key)
+		}
+	}
+	if tx.err != nil {
+		return nil, tx.err
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) ScriptLoad(ctx context.Context, script string) (string, error) {
+	fn, ok := memoryScripts[script]
+	if !ok {
+		return "", errors.New("script is not supported by the memory store")
+	}
+	sum := sha1.Sum([]byte(script))
+	sha := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	s.scripts[sha] = fn
+	s.mu.Unlock()
+	return sha, nil
+}
+
+func (s *MemoryStore) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) (interface{}, error) {
+	s.mu.RLock()
+	fn, ok := s.scripts[sha1]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("NOSCRIPT No matching script")
+	}
+	return s.run(keys, func(tx *memoryTx) interface{} {
+		return fn(tx, keys, args)
+	})
+}
+
+func (s *MemoryStore) EvalShaBatch(ctx context.Context, calls []redis.ScriptCall) []redis.ScriptResult {
+	results := make([]redis.ScriptResult, len(calls))
+	for i, call := range calls {
+		results[i].Value, results[i].Err = s.EvalSha(ctx, call.SHA, call.Keys, call.Args...)
+	}
+	return results
+}
+
+func (s *MemoryStore) Del(ctx context.Context, keys ...string) error {
+	_, err := s.run(keys, func(tx *memoryTx) interface{} {
+		for _, key := range keys {
+			tx.del(key)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *MemoryStore) GetCount(ctx context.Context, key string) (int64, error) {
+	result, err := s.run([]string{key}, func(tx *memoryTx) interface{} {
+		count, _ := tx.counter(key)
+		return count
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+func (s *MemoryStore) IncrementByWithExpiry(ctx context.Context, key string, n int64, expiry time.Duration) (int64, error) {
+	result, err := s.run([]string{key}, func(tx *memoryTx) interface{} {
+		count := tx.incrBy(key, n)
+		tx.pexpire(key, expiry.Milliseconds())
+		return count
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+func (s *MemoryStore) ZCount(ctx context.Context, key string, min, max string) (int64, error) {
+	lo, hi, err := parseScoreRange(min, max)
+	if err != nil {
+		return 0, err
+	}
+	result, err := s.run([]string{key}, func(tx *memoryTx) interface{} {
+		return int64(tx.zset(key).countByScore(lo, hi))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+func (s *MemoryStore) ZScoresByScore(ctx context.Context, key string, min, max string, offset, count int64) ([]float64, error) {
+	lo, hi, err := parseScoreRange(min, max)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.run([]string{key}, func(tx *memoryTx) interface{} {
+		items := tx.zset(key).rangeByScore(lo, hi, int(offset), int(count))
+		scores := make([]float64, len(items))
+		for i, item := range items {
+			scores[i] = item.score
+		}
+		return scores
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]float64), nil
+}
+
+func (s *MemoryStore) Health(ctx context.Context) error {
+	select {
+	case <-s.stop:
+		return errors.New("memory store is closed")
+	default:
+		return nil
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	s.closeOnce.Do(func() { close(s.stop) })
+	return nil
+}
+
+// memoryTx gives a script access to the keys whose shards are locked. The
+// first error, such as a key holding the wrong type, fails the script.
+type memoryTx struct {
+	store  *MemoryStore
+	locked map[int]bool
+	now    int64 // store clock in Unix milliseconds, used for expiry
+	err    error
+}
+
+func (tx *memoryTx) fail(err error) {
+	if tx.err == nil {
+		tx.err = err
+	}
+}
+
+func (tx *memoryTx) shard(key string) *memoryShard {
+	i := tx.store.shardIndex(key)
+	if !tx.locked[i] {
+		tx.fail(fmt.Errorf("key %s was not declared by the script", key))
+		return nil
+	}
+	return tx.store.shards[i]
+}
+
+// entry returns the live entry for key, or nil if it is missing or expired.
+func (tx *memoryTx) entry(key string) *memoryEntry {
+	shard := tx.shard(key)
+	if shard == nil {
+		return nil
+	}
+	e, ok := shard.entries[key]
+	if !ok {
+		return nil
+	}
+	if e.expired(tx.now) {
+		delete(shard.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (tx *memoryTx) put(key string, value interface{}, expiresAt int64) {
+	if shard := tx.shard(key); shard != nil {
+		shard.entries[key] = &memoryEntry{value: value, expiresAt: expiresAt}
+	}
+}
+
+func (tx *memoryTx) del(key string) {
+	if shard := tx.shard(key); shard != nil {
+		delete(shard.entries, key)
+	}
+}
+
+// pexpire sets the time to live of an existing key; like Redis, a time
+// that is not positive deletes it.
+func (tx *memoryTx) pexpire(key string, ms int64) {
+	e := tx.entry(key)
+	if e == nil {
+		return
+	}
+	if ms <= 0 {
+		tx.del(key)
+		return
+	}
+	e.expiresAt = tx.now + ms
+}
+
+// pttl returns the time to live of key in milliseconds, -1 when it has
+// none and -2 when it is missing, like PTTL.
+func (tx *memoryTx) pttl(key string) int64 {
+	e := tx.entry(key)
+	if e == nil {
+		return -2
+	}
+	if e.expiresAt == 0 {
+		return -1
+	}
+	return e.expiresAt - tx.now
+}
+
+func (tx *memoryTx) wrongType(key string) {
+	tx.fail(fmt.Errorf("WRONGTYPE key %s holds the wrong kind of value", key))
+}
+
+// zset returns the sorted set at key, creating an empty one if missing.
+func (tx *memoryTx) zset(key string) *memoryZSet {
+	if e := tx.entry(key); e != nil {
+		if z, ok := e.value.(*memoryZSet); ok {
+			return z
+		}
+		tx.wrongType(key)
+		return newMemoryZSet()
+	}
+	z := newMemoryZSet()
+	tx.put(key, z, 0)
+	return z
+}
+
+// hash returns the hash at key, creating an empty one if missing.
+func (tx *memoryTx) hash(key string) memoryHash {
+	if e := tx.entry(key); e != nil {
+		if h, ok := e.value.(memoryHash); ok {
+			return h
+		}
+		tx.wrongType(key)
+		return memoryHash{}
+	}
+	h := memoryHash{}
+	tx.put(key, h, 0)
+	return h
+}
+
+// counter returns the integer at key and whether it exists.
+func (tx *memoryTx) counter(key string) (int64, bool) {
+	e := tx.entry(key)
+	if e == nil {
+		return 0, false
+	}
+	n, ok := e.value.(int64)
+	if !ok {
+		tx.wrongType(key)
+	}
+	return n, ok
+}
+
+// setCounter replaces key with n, expiring after ms like SET key n PX ms.
+func (tx *memoryTx) setCounter(key string, n int64, ms int64) {
+	tx.put(key, n, tx.now+ms)
+}
+
+// incrBy adds n to the integer at key, keeping its time to live.
+func (tx *memoryTx) incrBy(key string, n int64) int64 {
+	e := tx.entry(key)
+	if e == nil {
+		tx.put(key, n, 0)
+		return n
+	}
+	count, ok := e.value.(int64)
+	if !ok {
+		tx.wrongType(key)
+		return 0
+	}
+	e.value = count + n
+	return count + n
+}
+
+func memoryEmpty(value interface{}) bool {
+	switch v := value.(type) {
+	case *memoryZSet:
+		return v.len() == 0
+	case memoryHash:
+		return len(v) == 0
+	}
+	return false
+}
+
+// memoryHash is a Redis hash of numeric fields.
+type memoryHash map[string]float64
+
+type memoryZItem struct {
+	score  float64
+	member string
+}
+
+// memoryZSet is a Redis sorted set: members ordered by score, then member.
+type memoryZSet struct {
+	items  []memoryZItem
+	scores map[string]float64
+}
+
+func newMemoryZSet() *memoryZSet {
+	return &memoryZSet{scores: make(map[string]float64)}
+}
+
+func (a memoryZItem) less(b memoryZItem) bool {
+	return a.score < b.score || (a.score == b.score && a.member < b.member)
+}
+
+func (z *memoryZSet) len() int {
+	return len(z.items)
+}
+
+func (z *memoryZSet) at(i int) memoryZItem {
+	return z.items[i]
+}
+
+func (z *memoryZSet) score(member string) (float64, bool) {
+	score, ok := z.scores[member]
+	return score, ok
+}
+
+// search returns the index of the first item not less than item.
+func (z *memoryZSet) search(item memoryZItem) int {
+	return sort.Search(len(z.items), func(i int) bool {
+		return !z.items[i].less(item)
+	})
+}
+
+func (z *memoryZSet) add(score float64, member string) {
+	if old, ok := z.scores[member]; ok {
+		if old == score {
+			return
+		}
+		z.remove(member)
+	}
+	item := memoryZItem{score: score, member: member}
+	i := z.search(item)
+	z.items = append(z.items, memoryZItem{})
+	copy(z.items[i+1:], z.items[i:])
+	z.items[i] = item
+	z.scores[member] = score
+}
+
+func (z *memoryZSet) remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	i := z.search(memoryZItem{score: score, member: member})
+	z.items = append(z.items[:i], z.items[i+1:]...)
+	delete(z.scores, member)
+	return true
+}
+
+// removeRangeByScore removes members scored within [min, max].
+func (z *memoryZSet) removeRangeByScore(min, max float64) {
+	lo := sort.Search(len(z.items), func(i int) bool { return z.items[i].score >= min })
+	hi := sort.Search(len(z.items), func(i int) bool { return z.items[i].score > max })
+	if lo >= hi {
+		return
+	}
+	for _, item := range z.items[lo:hi] {
+		delete(z.scores, item.member)
+	}
+	z.items = append(z.items[:lo], z.items[hi:]...)
+}
+
+// rangeByScore returns up to count members within min and max after
+// skipping offset of them; a negative count returns all.
+func (z *memoryZSet) rangeByScore(min, max scoreBound, offset, count int) []memoryZItem {
+	i := sort.Search(len(z.items), func(i int) bool { return min.below(z.items[i].score) })
+	var items []memoryZItem
+	for i += offset; i < len(z.items) && count != 0; i++ {
+		if !max.above(z.items[i].score) {
+			break
+		}
+		items = append(items, z.items[i])
+		count--
+	}
+	return items
+}
+
+// countByScore returns the number of members within min and max.
+func (z *memoryZSet) countByScore(min, max scoreBound) int {
+	lo := sort.Search(len(z.items), func(i int) bool { return min.below(z.items[i].score) })
+	hi := sort.Search(len(z.items), func(i int) bool { return !max.above(z.items[i].score) })
+	if hi < lo {
+		return 0
+	}
+	return hi - lo
+}
+
+// scoreBound is one end of a ZRANGEBYSCORE style range.
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+// below reports whether the range starting at b includes score.
+func (b scoreBound) below(score float64) bool {
+	return score > b.value || (score == b.value && !b.exclusive)
+}
+
+// above reports whether the range ending at b includes score.
+func (b scoreBound) above(score float64) bool {
+	return score < b.value || (score == b.value && !b.exclusive)
+}
+
+// parseScoreRange parses Redis score bounds such as "(100", "5" or "+inf".
+func parseScoreRange(min, max string) (scoreBound, scoreBound, error) {
+	lo, err := parseScoreBound(min)
+	if err != nil {
+		return scoreBound{}, scoreBound{}, err
+	}
+	hi, err := parseScoreBound(max)
+	if err != nil {
+		return scoreBound{}, scoreBound{}, err
+	}
+	return lo, hi, nil
+}
+
+func parseScoreBound(s string) (scoreBound, error) {
+	var b scoreBound
+	if len(s) > 0 && s[0] == '(' {
+		b.exclusive = true
+		s = s[1:]
+	}
+	switch s {
+	case "-inf":
+		b.value = math.Inf(-1)
+	case "+inf", "inf":
+		b.value = math.Inf(1)
+	default:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return scoreBound{}, fmt.Errorf("invalid score bound %q", s)
+		}
+		b.value = v
+	}
+	return b, nil
+}
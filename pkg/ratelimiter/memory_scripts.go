@@ -0,0 +1,413 @@
+package limiter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// memoryScript is the Go equivalent of a Lua script for MemoryStore. It
+// gets the same keys and arguments and returns the same reply.
+type memoryScript func(tx *memoryTx, keys []string, args []interface{}) interface{}
+
+// memoryScripts maps each Lua script to its Go equivalent. A change to a
+// script must be made to both.
+var memoryScripts = map[string]memoryScript{
+	slidingLogScript:     memorySlidingLog,
+	holdScript:           memoryHold,
+	multiLimitScript:     memoryMultiLimit,
+	tokenBucketScript:    memoryTokenBucket,
+	gcraScript:           memoryGCRA,
+	slidingCounterScript: memorySlidingCounter,
+	fixedWindowScript:    memoryFixedWindow,
+	leaseScript:          memoryLease,
+	releaseScript:        memoryRelease,
+}
+
+// argNum converts a script argument the way tonumber does in Lua.
+func argNum(arg interface{}) float64 {
+	switch v := arg.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
+
+// argTime is script_time from clockLua, with the store's clock as the
+// server time.
+func argTime(tx *memoryTx, arg interface{}, unit float64) float64 {
+	if argString(arg) == serverTimeArg {
+		return float64(tx.now) * unit / 1000
+	}
+	return argNum(arg)
+}
+
+func argString(arg interface{}) string {
+	return fmt.Sprint(arg)
+}
+
+// reply converts Lua numbers to the integers Redis would return, which
+// truncates them.
+func reply(vals ...float64) []interface{} {
+	out := make([]interface{}, len(vals))
+	for i, v := range vals {
+		out[i] = int64(v)
+	}
+	return out
+}
+
+// memoryExpireHolds is expire_holds from holdExpiryLua.
+func memoryExpireHolds(tx *memoryTx, holdsKey, unitsKey string, now float64) float64 {
+	holds, units := tx.zset(holdsKey), tx.hash(unitsKey)
+	expired := holds.rangeByScore(scoreBound{value: 0}, scoreBound{value: now}, 0, -1)
+	for _, hold := range expired {
+		delete(units, hold.member)
+	}
+	if len(expired) > 0 {
+		holds.removeRangeByScore(0, now)
+	}
+	held := 0.0
+	for _, cost := range units {
+		held += cost
+	}
+	return held
+}
+
+func holdMember(id string, i int) string {
+	return "h:" + id + ":" + strconv.Itoa(i)
+}
+
+// memoryLogTiming is log_timing from logTimingLua.
+func memoryLogTiming(log *memoryZSet, count, cost, limit float64) (float64, float64) {
+	oldest, freeing := -1.0, -1.0
+	if log.len() > 0 {
+		oldest = log.at(0).score
+	}
+	if excess := count + cost - limit; excess > 0 && count > 0 {
+		freeing = log.at(int(math.Min(excess, count)) - 1).score
+	}
+	return oldest, freeing
+}
+
+func memorySlidingLog(tx *memoryTx, keys []string, args []interface{}) interface{} {
+	now, window := argTime(tx, args[0], 1000), argNum(args[1])
+	limit := argNum(args[2]) - memoryExpireHolds(tx, keys[1], keys[2], now)
+	member, cost := argString(args[3]), argNum(args[4])
+
+	log := tx.zset(keys[0])
+	log.removeRangeByScore(0, now-window)
+	count := float64(log.len())
+	if cost == 0 {
+		oldest, freeing := memoryLogTiming(log, count, 1, limit)
+		allowed := 0.0
+		if count < limit {
+			allowed = 1
+		}
+		return reply(allowed, math.Max(0, limit-count), oldest, freeing, 0, now)
+	}
+	if argString(args[5]) == "1" {
+		if _, ok := log.score(member + ":1"); ok {
+			oldest, _ := memoryLogTiming(log, count, 0, limit)
+			return reply(1, math.Max(0, limit-count), oldest, -1, 1, now)
+		}
+	}
+	if count+cost > limit {
+		oldest, freeing := memoryLogTiming(log, count, cost, limit)
+		return reply(0, math.Max(0, limit-count), oldest, freeing, 0, now)
+	}
+	for i := 1; i <= int(cost); i++ {
+		log.add(now, member+":"+strconv.Itoa(i))
+	}
+	tx.pexpire(keys[0], int64(math.Ceil(window/1000)*2*1000))
+	count = float64(log.len())
+	oldest, _ := memoryLogTiming(log, count, 0, limit)
+	return reply(1, limit-count, oldest, -1, 0, now)
+}
+
+func memoryHold(tx *memoryTx, keys []string, args []interface{}) interface{} {
+	op, now, id := argString(args[0]), argTime(tx, args[1], 1000), argString(args[2])
+
+	held := memoryExpireHolds(tx, keys[1], keys[2], now)
+	log, holds, units := tx.zset(keys[0]), tx.zset(keys[1]), tx.hash(keys[2])
+
+	if op == "reserve" {
+		window, limit := argNum(args[3]), argNum(args[4])-held
+		cost, timeout := argNum(args[5]), argNum(args[6])
+		log.removeRangeByScore(0, now-window)
+		count := float64(log.len())
+		if count+cost > limit {
+			oldest, freeing := memoryLogTiming(log, count, cost, limit)
+			return reply(0, math.Max(0, limit-count), oldest, freeing, now)
+		}
+		holds.add(now+timeout, id)
+		units[id] = cost
+		expiry := max(tx.pttl(keys[1]), int64(timeout))
+		tx.pexpire(keys[1], expiry)
+		tx.pexpire(keys[2], expiry)
+		oldest, _ := memoryLogTiming(log, count, 0, limit)
+		return reply(1, limit-count-cost, oldest, -1, now)
+	}
+
+	cost, ok := units[id]
+	if !ok {
+		return reply(0, 0)
+	}
+	keep := 0.0
+	if op == "commit" {
+		keep = math.Min(argNum(args[3]), cost)
+		for i := 1; i <= int(keep); i++ {
+			log.add(now, holdMember(id, i))
+		}
+		if keep > 0 {
+			tx.pexpire(keys[0], max(tx.pttl(keys[0]), int64(argNum(args[4])*2)))
+		}
+	}
+	holds.remove(id)
+	delete(units, id)
+	return reply(1, cost-keep)
+}
+
+func memoryMultiLimit(tx *memoryTx, keys []string, args []interface{}) interface{} {
+	now, member, cost := argTime(tx, args[0], 1000), argString(args[1]), argNum(args[2])
+	window := func(i int) float64 { return argNum(args[4+2*i]) }
+	limit := func(i int) float64 { return argNum(args[5+2*i]) }
+	inWindow := func(i int, index int) float64 {
+		items := tx.zset(keys[i]).rangeByScore(scoreBound{value: now - window(i), exclusive: true}, scoreBound{value: math.Inf(1)}, index, 1)
+		if len(items) == 0 {
+			return -1
+		}
+		return items[0].score
+	}
+
+	// denied is the 1-based index of the first denying key, as in the script.
+	counts := make([]float64, len(keys))
+	denied := 0
+	for i := range keys {
+		counts[i] = float64(tx.zset(keys[i]).countByScore(scoreBound{value: now - window(i), exclusive: true}, scoreBound{value: math.Inf(1)}))
+		if denied == 0 && counts[i]+cost > limit(i) {
+			denied = i + 1
+		}
+	}
+
+	duplicate := 0.0
+	if argString(args[3]) == "1" && cost > 0 {
+		for i := range keys {
+			if score, ok := tx.zset(keys[i]).score(member + ":1"); ok && score > now-window(i) {
+				duplicate = 1
+				denied = 0
+				break
+			}
+		}
+	}
+
+	if denied == 0 && cost > 0 && duplicate == 0 {
+		for i, key := range keys {
+			log := tx.zset(key)
+			log.removeRangeByScore(0, now-window(i))
+			for j := 1; j <= int(cost); j++ {
+				log.add(now, member+":"+strconv.Itoa(j))
+			}
+			tx.pexpire(key, int64(window(i)*2))
+			counts[i] += cost
+		}
+	}
+
+	result := []float64{0, float64(denied), 0, duplicate}
+	if denied == 0 {
+		result[0] = 1
+	} else {
+		i := denied - 1
+		excess := math.Min(counts[i]+cost-limit(i), counts[i])
+		result[2] = window(i)
+		if excess > 0 {
+			if freeing := inWindow(i, int(excess)-1); freeing >= 0 {
+				result[2] = math.Max(0, freeing+window(i)-now)
+			}
+		}
+	}
+	for i := range keys {
+		result = append(result, math.Max(0, limit(i)-counts[i]))
+	}
+	for i := range keys {
+		result = append(result, inWindow(i, 0))
+	}
+	return reply(append(result, now)...)
+}
+
+func memoryTokenBucket(tx *memoryTx, keys []string, args []interface{}) interface{} {
+	now, rate, burst, requested := argTime(tx, args[0], 1000), argNum(args[1]), argNum(args[2]), argNum(args[3])
+
+	state := tx.hash(keys[0])
+	tokens, ok := state["tokens"]
+	ts, tsOK := state["ts"]
+	if !ok || !tsOK {
+		tokens = burst
+		ts = now
+	}
+	if now > ts {
+		tokens = math.Min(burst, tokens+(now-ts)*rate)
+		ts = now
+	}
+
+	allowed, retryAfter := 0.0, 0.0
+	if tokens >= requested {
+		tokens -= requested
+		allowed = 1
+	} else {
+		retryAfter = math.Ceil((requested - tokens) / rate)
+	}
+
+	if requested > 0 {
+		state["tokens"] = tokens
+		state["ts"] = ts
+		tx.pexpire(keys[0], int64(math.Ceil(burst/rate)))
+	}
+
+	return reply(allowed, math.Floor(tokens), math.Ceil((burst-tokens)/rate), retryAfter, now)
+}
+
+func memoryGCRA(tx *memoryTx, keys []string, args []interface{}) interface{} {
+	now, interval, tolerance, quantity := argTime(tx, args[0], 1000000), argNum(args[1]), argNum(args[2]), argNum(args[3])
+
+	tat := now
+	if stored, ok := tx.counter(keys[0]); ok && float64(stored) >= now {
+		tat = float64(stored)
+	}
+
+	newTat := tat + quantity*interval
+	diff := now - (newTat - tolerance)
+
+	if diff < 0 {
+		remaining := math.Floor((now - (tat - tolerance)) / interval)
+		return reply(0, remaining, math.Ceil((tat-now)/1000), math.Ceil(-diff/1000), now)
+	}
+
+	if quantity > 0 {
+		tx.setCounter(keys[0], int64(newTat), int64(math.Ceil((newTat-now)/1000)))
+	}
+
+	return reply(1, math.Floor(diff/interval), math.Ceil((newTat-now)/1000), 0, now)
+}
+
+func memorySlidingCounter(tx *memoryTx, keys []string, args []interface{}) interface{} {
+	now, window := argTime(tx, args[0], 1000), argNum(args[1])
+	limit, cost := argNum(args[2]), argNum(args[3])
+
+	index := math.Floor(now / window)
+	state := tx.hash(keys[0])
+	current, previous := 0.0, 0.0
+	if stored, ok := state["window"]; ok && stored == index {
+		current, previous = state["current"], state["previous"]
+	} else if ok && stored == index-1 {
+		previous = state["current"]
+	}
+
+	elapsed := math.Mod(now, window)
+	weight := (window - elapsed) / window
+	estimated := previous*weight + current
+
+	allowed := 0.0
+	if estimated+cost <= limit {
+		allowed = 1
+		if cost > 0 {
+			state["window"], state["current"], state["previous"] = index, current+cost, previous
+			tx.pexpire(keys[0], int64(window*2))
+			estimated += cost
+		}
+	}
+
+	retryAfter := 0.0
+	if allowed == 0 {
+		room := limit - current - cost
+		if room >= 0 && previous > 0 {
+			retryAfter = math.Ceil(window - room*window/previous - elapsed)
+		} else {
+			retryAfter = window - elapsed
+			nextRoom := limit - cost
+			if nextRoom < 0 {
+				retryAfter += window
+			} else if current > nextRoom {
+				retryAfter += math.Ceil(window - nextRoom*window/current)
+			}
+		}
+	}
+
+	return reply(allowed, math.Max(0, math.Floor(limit-estimated)), window-elapsed, retryAfter, now)
+}
+
+// memoryFixedWindowState is fixed_window from fixedWindowLua.
+func memoryFixedWindowState(state memoryHash, now, window float64) (start, count float64, current bool) {
+	start = now - math.Mod(now, window)
+	if stored, ok := state["start"]; !ok || stored != start {
+		return start, 0, false
+	}
+	return start, state["count"], true
+}
+
+func memoryFixedWindow(tx *memoryTx, keys []string, args []interface{}) interface{} {
+	now, window := argTime(tx, args[0], 1000), argNum(args[1])
+	cost, limit, slack := argNum(args[2]), argNum(args[3]), argNum(args[4])
+
+	start, count, current := memoryFixedWindowState(tx.hash(keys[0]), now, window)
+	if count+cost > limit {
+		return reply(0, count, start, now)
+	}
+	if cost > 0 {
+		if !current {
+			tx.del(keys[0])
+			tx.hash(keys[0])["start"] = start
+		}
+		state := tx.hash(keys[0])
+		state["count"] += cost
+		count = state["count"]
+		tx.pexpire(keys[0], int64(start+window-now+slack))
+	}
+	return reply(1, count, start, now)
+}
+
+func memoryLease(tx *memoryTx, keys []string, args []interface{}) interface{} {
+	now, window := argTime(tx, args[0], 1000), argNum(args[1])
+	size, least, limit, slack := argNum(args[2]), argNum(args[3]), argNum(args[4]), argNum(args[5])
+
+	start, count, current := memoryFixedWindowState(tx.hash(keys[0]), now, window)
+	if !current {
+		tx.del(keys[0])
+	}
+	state := tx.hash(keys[0])
+	generation, ok := state["gen"]
+	if !ok {
+		generation = argNum(args[6])
+		state["start"], state["gen"] = start, generation
+	}
+	granted := math.Min(size, limit-count)
+	if granted >= least {
+		state["count"] += granted
+		count = state["count"]
+	} else {
+		granted = 0
+	}
+	tx.pexpire(keys[0], int64(start+window-now+slack))
+	return reply(granted, count, start, now, generation)
+}
+
+func memoryRelease(tx *memoryTx, keys []string, args []interface{}) interface{} {
+	state := tx.hash(keys[0])
+	if start, ok := state["start"]; !ok || start != argNum(args[1]) {
+		return int64(0)
+	}
+	if generation, ok := state["gen"]; !ok || generation != argNum(args[2]) {
+		return int64(0)
+	}
+	units := math.Min(argNum(args[0]), state["count"])
+	if units > 0 {
+		state["count"] -= units
+	}
+	return int64(units)
+}
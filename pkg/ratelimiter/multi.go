@@ -0,0 +1,343 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+)
+
+// The multi-limit script runs the sliding log over several sorted sets at
+// once. Every set is checked before any is written, so a request denied by
+// one limit is not charged against the others. When the request is marked
+// idempotent and its first member is still in any of the windows, it was
+// admitted before and is reported as allowed without charging again; the
+// shorter windows may have let it go while the longer ones still count it.
+//
+// KEYS: one sorted set per limit.
+// ARGV: now (ms), member, cost, idempotent (1 or 0), then window (ms) and
+// limit per key. A cost of zero only reports the state and writes nothing.
+// Returns {allowed, index of the first denying key or 0, ms until that key
+// has room or 0, duplicate, remaining per key..., oldest in-window score per
+// key or -1..., now}.
+const multiLimitScript = clockLua + `
+local now = script_time(ARGV[1], 1000)
+local member = ARGV[2]
+local cost = tonumber(ARGV[3])
+
+local counts = {}
+local denied = 0
+for i = 1, #KEYS do
+    local window = tonumber(ARGV[3 + i * 2])
+    local limit = tonumber(ARGV[4 + i * 2])
+    counts[i] = redis.call("ZCOUNT", KEYS[i], "(" .. (now - window), "+inf")
+    if denied == 0 and counts[i] + cost > limit then
+        denied = i
+    end
+end
+
+local duplicate = 0
+if ARGV[4] == "1" and cost > 0 then
+    for i = 1, #KEYS do
+        local score = redis.call("ZSCORE", KEYS[i], member .. ":1")
+        if score and tonumber(score) > now - tonumber(ARGV[3 + i * 2]) then
+            duplicate = 1
+            denied = 0
+            break
+        end
+    end
+end
+
+if denied == 0 and cost > 0 and duplicate == 0 then
+    for i = 1, #KEYS do
+        local window = tonumber(ARGV[3 + i * 2])
+        redis.call("ZREMRANGEBYSCORE", KEYS[i], 0, now - window)
+        for j = 1, cost do
+            redis.call("ZADD", KEYS[i], now, member .. ":" .. j)
+        end
+        redis.call("PEXPIRE", KEYS[i], window * 2)
+        counts[i] = counts[i] + cost
+    end
+end
+
+local function in_window(key, window, index)
+    local entry = redis.call("ZRANGEBYSCORE", key, "(" .. (now - window), "+inf", "WITHSCORES", "LIMIT", index, 1)
+    if #entry == 0 then
+        return -1
+    end
+    return tonumber(entry[2])
+end
+
+local result = {0, denied, 0, duplicate}
+if denied == 0 then
+    result[1] = 1
+else
+    local window = tonumber(ARGV[3 + denied * 2])
+    local limit = tonumber(ARGV[4 + denied * 2])
+    local excess = math.min(counts[denied] + cost - limit, counts[denied])
+    result[3] = window
+    if excess > 0 then
+        local freeing = in_window(KEYS[denied], window, excess - 1)
+        if freeing >= 0 then
+            result[3] = math.max(0, freeing + window - now)
+        end
+    end
+end
+for i = 1, #KEYS do
+    local window = tonumber(ARGV[3 + i * 2])
+    result[4 + i] = math.max(0, tonumber(ARGV[4 + i * 2]) - counts[i])
+    result[4 + #KEYS + i] = in_window(KEYS[i], window, 0)
+end
+result[5 + 2 * #KEYS] = now
+return result
+`
+
+const multiLimitKeyPrefix = "ml:"
+
+// Rule is one limit in a set of limits enforced together.
+type Rule struct {
+	// Name identifies the rule in responses; it defaults to "limit/window".
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+func (r Rule) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("%d/%s", r.Limit, r.Window)
+}
+
+// LimitStatus reports the state of one rule after a check.
+type LimitStatus struct {
+	Name      string    `json:"name"`
+	Limit     int       `json:"limit"`
+	Window    string    `json:"window"`
+	Remaining int       `json:"remaining"`
+	ResetTime time.Time `json:"reset_time"`
+}
+
+// logCheck is one sorted set evaluated by multiLimitScript.
+type logCheck struct {
+	key  string
+	rule Rule
+}
+
+// minLimit returns the smallest limit of checks.
+func minLimit(checks []logCheck) int {
+	limit := checks[0].rule.Limit
+	for _, c := range checks[1:] {
+		limit = min(limit, c.rule.Limit)
+	}
+	return limit
+}
+
+// logEvaluator runs multiLimitScript for a set of checks.
+type logEvaluator struct {
+	Store Store
+	sha   string
+
+	timing
+}
+
+func newLogEvaluator(cfg *config.Config) (*logEvaluator, error) {
+	t, err := newTiming(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sha, err := store.ScriptLoad(context.Background(), multiLimitScript)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load script: %w", err)
+	}
+
+	return &logEvaluator{Store: store, timing: t, sha: sha}, nil
+}
+
+// eval checks every rule atomically and builds a response whose Remaining
+// and ResetTime come from the most constrained rule.
+func (e *logEvaluator) eval(ctx context.Context, clientID string, checks []logCheck, requestID string, cost int) (RateLimitResponse, error) {
+	return evalCall(ctx, e.Store, e.call(clientID, checks, requestID, cost))
+}
+
+func (e *logEvaluator) call(clientID string, checks []logCheck, requestID string, cost int) scriptCall {
+	now := e.now().UnixMilli()
+
+	member, idempotent := logMember(now, clientID, requestID)
+	keys := make([]string, len(checks))
+	args := []interface{}{e.scriptTime(now), member, cost, idempotent}
+	for i, c := range checks {
+		keys[i] = c.key
+		args = append(args, c.rule.Window.Milliseconds(), c.rule.Limit)
+	}
+
+	call := newScriptCall("multi-limit", e.sha, keys, args...)
+	call.decode = func(result interface{}) (RateLimitResponse, error) {
+		vals, err := parseScriptResult(result, 5+2*len(checks))
+		if err != nil {
+			return RateLimitResponse{}, err
+		}
+		return e.response(vals[len(vals)-1], clientID, checks, requestID, vals), nil
+	}
+	return call
+}
+
+// response decodes the script reply for checks.
+func (e *logEvaluator) response(now int64, clientID string, checks []logCheck, requestID string, vals []int64) RateLimitResponse {
+	resp := RateLimitResponse{
+		Allowed:   vals[0] != 0,
+		Duplicate: vals[3] != 0,
+		Remaining: -1,
+		ClientID:  clientID,
+		RequestID: requestID,
+		Limits:    make([]LimitStatus, len(checks)),
+	}
+	for i, c := range checks {
+		window := c.rule.Window.Milliseconds()
+		// A rule frees up when its oldest entry leaves the window.
+		resetTime := time.UnixMilli(now)
+		if oldest := vals[4+len(checks)+i]; oldest >= 0 {
+			resetTime = time.UnixMilli(oldest + window)
+		}
+		status := LimitStatus{
+			Name:      c.rule.name(),
+			Limit:     c.rule.Limit,
+			Window:    c.rule.Window.String(),
+			Remaining: int(vals[4+i]),
+			ResetTime: resetTime,
+		}
+		resp.Limits[i] = status
+
+		if resp.Remaining < 0 || status.Remaining < resp.Remaining {
+			resp.Remaining = status.Remaining
+			resp.ResetTime = status.ResetTime
+			resp.WindowStart = time.UnixMilli(now - window)
+		}
+	}
+
+	if denied := vals[1]; denied > 0 {
+		status := resp.Limits[denied-1]
+		resp.ViolatedLimit = status.Name
+		resp.ResetTime = status.ResetTime
+		resp.RetryAfterMs = vals[2]
+		resp.WindowStart = time.UnixMilli(now - checks[denied-1].rule.Window.Milliseconds())
+	}
+	return resp
+}
+
+func (e *logEvaluator) reset(ctx context.Context, checks []logCheck) error {
+	keys := make([]string, len(checks))
+	for i, c := range checks {
+		keys[i] = c.key
+	}
+	return e.Store.Del(ctx, keys...)
+}
+
+func (e *logEvaluator) CircuitState() string {
+	return circuitState(e.Store)
+}
+
+func (e *logEvaluator) ShardHealth(ctx context.Context) map[string]string {
+	return shardHealth(ctx, e.Store)
+}
+
+var _ Limiter = (*MultiLimiter)(nil)
+
+// MultiLimiter enforces several sliding log limits on the same key, such as
+// 10 per second and 1000 per hour. A request is admitted only if every rule
+// admits it, and is charged against all of them or none.
+type MultiLimiter struct {
+	*logEvaluator
+	rules []Rule
+}
+
+func NewMultiLimiter(cfg *config.Config, rules ...Rule) (*MultiLimiter, error) {
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("multi limiter needs at least one rule")
+	}
+	// Each window gets its own sorted set, so windows must be distinct.
+	windows := make(map[time.Duration]bool, len(rules))
+	for _, r := range rules {
+		if r.Limit <= 0 || r.Window.Milliseconds() <= 0 {
+			return nil, fmt.Errorf("invalid rule %s", r.name())
+		}
+		if windows[r.Window] {
+			return nil, fmt.Errorf("duplicate rule window %s", r.Window)
+		}
+		windows[r.Window] = true
+	}
+
+	e, err := newLogEvaluator(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &MultiLimiter{logEvaluator: e, rules: rules}, nil
+}
+
+// Capacity is the limit of the strictest rule.
+func (l *MultiLimiter) Capacity() int {
+	return minLimit(l.checks(""))
+}
+
+func (l *MultiLimiter) checks(key string) []logCheck {
+	checks := make([]logCheck, len(l.rules))
+	for i, r := range l.rules {
+		checks[i] = logCheck{
+			key:  multiLimitKeyPrefix + hashTag(key) + ":" + r.Window.String(),
+			rule: r,
+		}
+	}
+	return checks
+}
+
+func (l *MultiLimiter) Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error) {
+	return l.AllowN(ctx, key, requestID, 1)
+}
+
+func (l *MultiLimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error) {
+	if err := validateCost(cost); err != nil {
+		return RateLimitResponse{}, err
+	}
+	return l.eval(ctx, key, l.checks(key), requestID, cost)
+}
+
+func (l *MultiLimiter) AllowBatch(ctx context.Context, checks []Check) []BatchResult {
+	return evalBatch(ctx, l.Store, checks, checkCalls(func(key, requestID string, cost int) scriptCall {
+		return l.call(key, l.checks(key), requestID, cost)
+	}))
+}
+
+func (l *MultiLimiter) Peek(ctx context.Context, key string) (RateLimitResponse, error) {
+	resp, err := l.eval(ctx, key, l.checks(key), "", 0)
+	if err != nil {
+		return RateLimitResponse{}, err
+	}
+	resp.Allowed = resp.Remaining >= 1
+	return resp, nil
+}
+
+func (l *MultiLimiter) Reset(ctx context.Context, key string) error {
+	if err := l.reset(ctx, l.checks(key)); err != nil {
+		return fmt.Errorf("failed to reset %s: %w", key, err)
+	}
+	return nil
+}
+
+func (l *MultiLimiter) Health(ctx context.Context) error {
+	if err := l.Store.Health(ctx); err != nil {
+		return fmt.Errorf("redis health check failed: %w", err)
+	}
+	return nil
+}
+
+func (l *MultiLimiter) Close() error {
+	return l.Store.Close()
+}
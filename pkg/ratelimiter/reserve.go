@@ -0,0 +1,107 @@
+package limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// minRetryDelay keeps Wait from spinning when a limiter reports a denial
+// whose reset time has already passed.
+const minRetryDelay = time.Millisecond
+
+// Reservation is the outcome of Reserve.
+type Reservation struct {
+	// OK reports whether the units were consumed. Unlike a
+	// golang.org/x/time/rate reservation, a delayed reservation does not hold
+	// units for the caller: it must check again once Delay has elapsed.
+	OK bool
+	// Delay is how long to wait before the request would be permitted.
+	Delay    time.Duration
+	Response RateLimitResponse
+}
+
+// Reserve tries to consume cost units for key and, if they are not
+// available, reports how long to wait before trying again.
+func Reserve(ctx context.Context, l Limiter, key string, cost int) (Reservation, error) {
+	resp, err := l.AllowN(ctx, key, newRequestID(), cost)
+	if err != nil {
+		return Reservation{}, err
+	}
+	if resp.Allowed {
+		return Reservation{OK: true, Response: resp}, nil
+	}
+	return Reservation{Delay: retryDelay(resp), Response: resp}, nil
+}
+
+// CapacityReporter is implemented by limiters that know the largest cost a
+// single check can ever be granted.
+type CapacityReporter interface {
+	Capacity() int
+}
+
+// capacity returns l's capacity, or 0 when it is not known.
+func capacity(l Limiter) int {
+	if c, ok := l.(CapacityReporter); ok {
+		return c.Capacity()
+	}
+	return 0
+}
+
+// Wait blocks until one unit for key has been consumed or ctx is done.
+func Wait(ctx context.Context, l Limiter, key string) error {
+	return WaitN(ctx, l, key, 1)
+}
+
+// WaitN blocks until cost units for key have been consumed or ctx is done.
+// It returns early if the next attempt would fall after the ctx deadline,
+// and at once if cost exceeds what l can ever grant.
+func WaitN(ctx context.Context, l Limiter, key string, cost int) error {
+	if c := capacity(l); c > 0 && cost > c {
+		return fmt.Errorf("rate limit wait for %d units exceeds the limiter's capacity of %d", cost, c)
+	}
+	for {
+		r, err := Reserve(ctx, l, key, cost)
+		if err != nil {
+			return err
+		}
+		if r.OK {
+			return nil
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(r.Delay).After(deadline) {
+			return fmt.Errorf("rate limit wait of %v would exceed context deadline", r.Delay)
+		}
+
+		timer := time.NewTimer(r.Delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryDelay prefers the limiter's retry hint and otherwise waits until the
+// reported reset time.
+func retryDelay(resp RateLimitResponse) time.Duration {
+	delay := time.Duration(resp.RetryAfterMs) * time.Millisecond
+	if delay <= 0 {
+		delay = time.Until(resp.ResetTime)
+	}
+	if delay < minRetryDelay {
+		delay = minRetryDelay
+	}
+	return delay
+}
+
+// newRequestID generates an ID for checks that have no caller-supplied one,
+// so that sliding log members stay unique.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
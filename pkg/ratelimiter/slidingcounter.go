@@ -0,0 +1,208 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+)
+
+// The sliding window counter approximates the sliding log with two fixed
+// window counters. The previous window's count is weighted by the fraction
+// of it that still overlaps the sliding window ending now.
+//
+// Both counters live in one hash with the number of the current window,
+// counted from the Unix epoch. The script numbers windows by its own clock
+// and shifts the counters when a new window starts.
+//
+// KEYS: counters hash.
+// ARGV: now (ms), window (ms), limit, cost. A cost of zero writes nothing.
+// Returns {allowed, remaining, ms until the current window ends, ms until
+// the estimate leaves room for cost or 0 when allowed, now}.
+const slidingCounterScript = clockLua + `
+local key = KEYS[1]
+local now = script_time(ARGV[1], 1000)
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local index = math.floor(now / window)
+local state = redis.call("HMGET", key, "window", "current", "previous")
+local stored = tonumber(state[1])
+local current, previous = 0, 0
+if stored == index then
+    current = tonumber(state[2]) or 0
+    previous = tonumber(state[3]) or 0
+elseif stored == index - 1 then
+    previous = tonumber(state[2]) or 0
+end
+
+local elapsed = now % window
+local weight = (window - elapsed) / window
+local estimated = previous * weight + current
+
+local allowed = 0
+if estimated + cost <= limit then
+    allowed = 1
+    if cost > 0 then
+        redis.call("HSET", key, "window", index, "current", current + cost, "previous", previous)
+        redis.call("PEXPIRE", key, window * 2)
+        estimated = estimated + cost
+    end
+end
+
+-- The estimate only falls as the previous window's weight decays, or at
+-- the boundary when the current count becomes the previous one.
+local retry_after = 0
+if allowed == 0 then
+    local room = limit - current - cost
+    if room >= 0 and previous > 0 then
+        retry_after = math.ceil(window - room * window / previous - elapsed)
+    else
+        retry_after = window - elapsed
+        local next_room = limit - cost
+        if next_room < 0 then
+            retry_after = retry_after + window
+        elseif current > next_room then
+            retry_after = retry_after + math.ceil(window - next_room * window / current)
+        end
+    end
+end
+
+return {allowed, math.max(0, math.floor(limit - estimated)), window - elapsed, retry_after, now}
+`
+
+const slidingCounterKeyPrefix = "swc:"
+
+var _ Limiter = (*SlidingWindowCounterLimiter)(nil)
+
+// SlidingWindowCounterLimiter uses two counters per key instead of one entry
+// per request. It can over- or under-admit slightly because it assumes the
+// previous window's requests were evenly spread, so keys that need exact
+// enforcement should keep the sliding log.
+type SlidingWindowCounterLimiter struct {
+	Store      Store
+	limit      int
+	windowSize time.Duration
+	sha        string
+
+	timing
+}
+
+func NewSlidingWindowCounterLimiter(cfg *config.Config, limit int, windowSize time.Duration) (*SlidingWindowCounterLimiter, error) {
+	if limit <= 0 || windowSize.Milliseconds() <= 0 {
+		return nil, fmt.Errorf("invalid sliding window counter: %d per %v", limit, windowSize)
+	}
+
+	t, err := newTiming(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sha, err := store.ScriptLoad(context.Background(), slidingCounterScript)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load script: %w", err)
+	}
+
+	return &SlidingWindowCounterLimiter{
+		Store:      store,
+		timing:     t,
+		limit:      limit,
+		windowSize: windowSize,
+		sha:        sha,
+	}, nil
+}
+
+func (l *SlidingWindowCounterLimiter) Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error) {
+	return l.AllowN(ctx, key, requestID, 1)
+}
+
+func (l *SlidingWindowCounterLimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error) {
+	if err := validateCost(cost); err != nil {
+		return RateLimitResponse{}, err
+	}
+	return evalCall(ctx, l.Store, l.allowCall(key, requestID, cost))
+}
+
+func (l *SlidingWindowCounterLimiter) AllowBatch(ctx context.Context, checks []Check) []BatchResult {
+	return evalBatch(ctx, l.Store, checks, checkCalls(l.allowCall))
+}
+
+func (l *SlidingWindowCounterLimiter) Peek(ctx context.Context, key string) (RateLimitResponse, error) {
+	resp, err := evalCall(ctx, l.Store, l.call(key, 0))
+	if err != nil {
+		return RateLimitResponse{}, err
+	}
+	resp.Allowed = resp.Remaining >= 1
+	return resp, nil
+}
+
+func slidingCounterKey(key string) string {
+	return slidingCounterKeyPrefix + hashTag(key)
+}
+
+func (l *SlidingWindowCounterLimiter) allowCall(key string, requestID string, cost int) scriptCall {
+	return l.call(key, cost).withRequestID(requestID)
+}
+
+// call charges cost units to key; zero only reports the state.
+func (l *SlidingWindowCounterLimiter) call(key string, cost int) scriptCall {
+	now := l.now().UnixMilli()
+	window := l.windowSize.Milliseconds()
+
+	call := newScriptCall("sliding window counter", l.sha, []string{slidingCounterKey(key)}, l.scriptTime(now), window, l.limit, cost)
+	call.decode = func(result interface{}) (RateLimitResponse, error) {
+		vals, err := parseScriptResult(result, 5)
+		if err != nil {
+			return RateLimitResponse{}, err
+		}
+		now := vals[4]
+
+		return RateLimitResponse{
+			Allowed:      vals[0] != 0,
+			Remaining:    int(vals[1]),
+			ResetTime:    time.UnixMilli(now + vals[2]),
+			WindowStart:  time.UnixMilli(now - window),
+			RetryAfterMs: vals[3],
+			ClientID:     key,
+		}, nil
+	}
+	return call
+}
+
+func (l *SlidingWindowCounterLimiter) Reset(ctx context.Context, key string) error {
+	if err := l.Store.Del(ctx, slidingCounterKey(key)); err != nil {
+		return fmt.Errorf("failed to reset %s: %w", key, err)
+	}
+	return nil
+}
+
+func (l *SlidingWindowCounterLimiter) Health(ctx context.Context) error {
+	if err := l.Store.Health(ctx); err != nil {
+		return fmt.Errorf("redis health check failed: %w", err)
+	}
+	return nil
+}
+
+func (l *SlidingWindowCounterLimiter) CircuitState() string {
+	return circuitState(l.Store)
+}
+
+func (l *SlidingWindowCounterLimiter) ShardHealth(ctx context.Context) map[string]string {
+	return shardHealth(ctx, l.Store)
+}
+
+func (l *SlidingWindowCounterLimiter) Capacity() int {
+	return l.limit
+}
+
+func (l *SlidingWindowCounterLimiter) Close() error {
+	return l.Store.Close()
+}
@@ -0,0 +1,80 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+	"github.com/mshort2/distributed-rate-limiter/pkg/redis"
+)
+
+// Store backends accepted in config.StoreConfig.Backend.
+const (
+	StoreRedis  = "redis"
+	StoreMemory = "memory"
+)
+
+// Store is the storage limiters keep their state in. It is implemented by
+// *redis.Client and by MemoryStore, which runs Go equivalents of the Lua
+// scripts so that every limiter works unchanged on either.
+type Store interface {
+	ScriptLoad(ctx context.Context, script string) (string, error)
+	EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) (interface{}, error)
+	EvalShaBatch(ctx context.Context, calls []redis.ScriptCall) []redis.ScriptResult
+	Del(ctx context.Context, keys ...string) error
+	GetCount(ctx context.Context, key string) (int64, error)
+	IncrementByWithExpiry(ctx context.Context, key string, n int64, expiry time.Duration) (int64, error)
+	ZCount(ctx context.Context, key string, min, max string) (int64, error)
+	ZScoresByScore(ctx context.Context, key string, min, max string, offset, count int64) ([]float64, error)
+	Health(ctx context.Context) error
+	Close() error
+}
+
+var (
+	_ Store = (*redis.Client)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// CircuitReporter is implemented by stores guarded by a circuit breaker and
+// by the limiters using them. CircuitState returns "" when there is none.
+type CircuitReporter interface {
+	CircuitState() string
+}
+
+func circuitState(s Store) string {
+	if c, ok := s.(CircuitReporter); ok {
+		return c.CircuitState()
+	}
+	return ""
+}
+
+// ShardReporter is implemented by stores that spread keys over several
+// servers and by the limiters using them. ShardHealth maps each server to
+// "healthy" or its error, and returns nil when the store is not sharded.
+type ShardReporter interface {
+	ShardHealth(ctx context.Context) map[string]string
+}
+
+func shardHealth(ctx context.Context, s Store) map[string]string {
+	if r, ok := s.(ShardReporter); ok {
+		return r.ShardHealth(ctx)
+	}
+	return nil
+}
+
+// newStore creates the store selected by cfg.Store.Backend.
+func newStore(cfg *config.Config) (Store, error) {
+	switch cfg.Store.Backend {
+	case StoreRedis, "":
+		client, err := redis.NewClient(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+		}
+		return client, nil
+	case StoreMemory:
+		return NewMemoryStore(cfg.Store.MemoryShards, cfg.Store.MemoryCleanupInterval), nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", cfg.Store.Backend)
+	}
+}
@@ -0,0 +1,187 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+)
+
+// Token bucket state is a hash holding the fractional token count and the
+// millisecond timestamp of the last refill. Tokens are refilled lazily on
+// every call, so no background process is needed.
+//
+// ARGV: now (ms), refill rate (tokens per ms), burst, tokens requested.
+// A request for zero tokens only reports the state and writes nothing.
+// Returns {allowed, remaining, ms until the bucket is full again, ms until
+// the requested tokens are available or 0 when allowed, now}.
+const tokenBucketScript = clockLua + `
+local key = KEYS[1]
+local now = script_time(ARGV[1], 1000)
+local rate = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local requested = tonumber(ARGV[4])
+
+local state = redis.call("HMGET", key, "tokens", "ts")
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+    tokens = burst
+    ts = now
+end
+if now > ts then
+    tokens = math.min(burst, tokens + (now - ts) * rate)
+    ts = now
+end
+
+local allowed = 0
+local retry_after = 0
+if tokens >= requested then
+    tokens = tokens - requested
+    allowed = 1
+else
+    retry_after = math.ceil((requested - tokens) / rate)
+end
+
+if requested > 0 then
+    redis.call("HSET", key, "tokens", tokens, "ts", ts)
+    redis.call("PEXPIRE", key, math.ceil(burst / rate))
+end
+
+return {allowed, math.floor(tokens), math.ceil((burst - tokens) / rate), retry_after, now}
+`
+
+const tokenBucketKeyPrefix = "tb:"
+
+var _ Limiter = (*TokenBucketLimiter)(nil)
+
+// TokenBucketLimiter admits bursts of up to burst requests and then refills
+// at a steady rate, unlike the sliding log which only enforces a window.
+type TokenBucketLimiter struct {
+	Store Store
+	rate  float64 // tokens per second
+	burst int
+	sha   string
+
+	timing
+}
+
+// NewTokenBucketLimiter creates a limiter that refills rate tokens per second
+// into a bucket holding at most burst tokens.
+func NewTokenBucketLimiter(cfg *config.Config, rate float64, burst int) (*TokenBucketLimiter, error) {
+	if rate <= 0 || burst <= 0 {
+		return nil, fmt.Errorf("invalid token bucket: rate %v, burst %d", rate, burst)
+	}
+
+	t, err := newTiming(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sha, err := store.ScriptLoad(context.Background(), tokenBucketScript)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load script: %w", err)
+	}
+
+	return &TokenBucketLimiter{
+		Store:  store,
+		timing: t,
+		rate:   rate,
+		burst:  burst,
+		sha:    sha,
+	}, nil
+}
+
+func (l *TokenBucketLimiter) Allow(ctx context.Context, key string, requestID string) (RateLimitResponse, error) {
+	return l.AllowN(ctx, key, requestID, 1)
+}
+
+func (l *TokenBucketLimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (RateLimitResponse, error) {
+	if err := validateCost(cost); err != nil {
+		return RateLimitResponse{}, err
+	}
+	return evalCall(ctx, l.Store, l.allowCall(key, requestID, cost))
+}
+
+func (l *TokenBucketLimiter) AllowBatch(ctx context.Context, checks []Check) []BatchResult {
+	return evalBatch(ctx, l.Store, checks, checkCalls(l.allowCall))
+}
+
+func (l *TokenBucketLimiter) Peek(ctx context.Context, key string) (RateLimitResponse, error) {
+	resp, err := evalCall(ctx, l.Store, l.call(key, 0))
+	if err != nil {
+		return RateLimitResponse{}, err
+	}
+	resp.Allowed = resp.Remaining >= 1
+	return resp, nil
+}
+
+func (l *TokenBucketLimiter) allowCall(key string, requestID string, cost int) scriptCall {
+	return l.call(key, cost).withRequestID(requestID)
+}
+
+// call requests tokens for key; zero tokens only reports the state.
+func (l *TokenBucketLimiter) call(key string, requested int) scriptCall {
+	now := l.now().UnixMilli()
+
+	call := newScriptCall("token bucket", l.sha, []string{tokenBucketKeyPrefix + hashTag(key)}, l.scriptTime(now), l.rate/1000, l.burst, requested)
+	call.decode = func(result interface{}) (RateLimitResponse, error) {
+		vals, err := parseScriptResult(result, 5)
+		if err != nil {
+			return RateLimitResponse{}, err
+		}
+		now := vals[4]
+
+		// The bucket refills continuously, so the nominal window is the time
+		// it takes to refill from empty.
+		window := int64(math.Ceil(float64(l.burst) / l.rate * 1000))
+
+		return RateLimitResponse{
+			Allowed:      vals[0] != 0,
+			Remaining:    int(vals[1]),
+			ResetTime:    time.UnixMilli(now + vals[2]),
+			WindowStart:  time.UnixMilli(now - window),
+			RetryAfterMs: vals[3],
+			ClientID:     key,
+		}, nil
+	}
+	return call
+}
+
+func (l *TokenBucketLimiter) Reset(ctx context.Context, key string) error {
+	if err := l.Store.Del(ctx, tokenBucketKeyPrefix+hashTag(key)); err != nil {
+		return fmt.Errorf("failed to reset %s: %w", key, err)
+	}
+	return nil
+}
+
+func (l *TokenBucketLimiter) Health(ctx context.Context) error {
+	if err := l.Store.Health(ctx); err != nil {
+		return fmt.Errorf("redis health check failed: %w", err)
+	}
+	return nil
+}
+
+func (l *TokenBucketLimiter) CircuitState() string {
+	return circuitState(l.Store)
+}
+
+func (l *TokenBucketLimiter) ShardHealth(ctx context.Context) map[string]string {
+	return shardHealth(ctx, l.Store)
+}
+
+func (l *TokenBucketLimiter) Capacity() int {
+	return l.burst
+}
+
+func (l *TokenBucketLimiter) Close() error {
+	return l.Store.Close()
+}
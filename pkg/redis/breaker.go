@@ -0,0 +1,163 @@
+package redis
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+)
+
+// ErrCircuitOpen is returned without contacting Redis while the circuit
+// breaker is open
+var ErrCircuitOpen = errors.New("redis circuit breaker is open")
+
+// Circuit breaker states
+const (
+    CircuitClosed   = "closed"
+    CircuitOpen     = "open"
+    CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreaker opens after threshold consecutive failures and fails
+// calls fast for cooldown. It then lets a single probe through: success
+// closes the circuit, failure opens it again. A nil breaker never opens.
+type CircuitBreaker struct {
+    threshold int
+    cooldown  time.Duration
+
+    mu       sync.Mutex
+    state    string
+    failures int
+    openedAt time.Time
+    probing  bool
+}
+
+// NewCircuitBreaker returns a breaker, or nil when threshold is not
+// positive
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+    if threshold <= 0 {
+        return nil
+    }
+    return &CircuitBreaker{threshold: threshold, cooldown: cooldown, state: CircuitClosed}
+}
+
+// Allow reports whether a call may go to Redis
+func (b *CircuitBreaker) Allow() bool {
+    if b == nil {
+        return true
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    switch b.state {
+    case CircuitOpen:
+        if time.Since(b.openedAt) < b.cooldown {
+            return false
+        }
+        b.state = CircuitHalfOpen
+        b.probing = true
+        return true
+    case CircuitHalfOpen:
+        if b.probing {
+            return false
+        }
+        b.probing = true
+        return true
+    }
+    return true
+}
+
+// Record updates the breaker with the outcome of an allowed call. Replies
+// from Redis, including errors such as a missing script, show that it is
+// reachable; a call cancelled by its caller says nothing either way.
+func (b *CircuitBreaker) Record(err error) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    var reply redis.Error
+    switch {
+    case errors.Is(err, ErrCircuitOpen):
+        // Rejected by Allow, so Redis was not contacted
+    case err == nil, err == redis.Nil, errors.As(err, &reply):
+        b.state = CircuitClosed
+        b.failures = 0
+        b.probing = false
+    case errors.Is(err, context.Canceled):
+        b.probing = false
+    default:
+        b.failures++
+        if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+            b.state = CircuitOpen
+            b.openedAt = time.Now()
+            b.probing = false
+        }
+    }
+}
+
+// State returns the circuit state, or "" for a nil breaker
+func (b *CircuitBreaker) State() string {
+    if b == nil {
+        return ""
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.state
+}
+
+// callHook applies the circuit breaker and the per-operation deadline to
+// every command and pipeline. The deadline covers go-redis retries too.
+type callHook struct {
+    breaker *CircuitBreaker
+    timeout time.Duration
+}
+
+type cancelKey struct{}
+
+func (h callHook) before(ctx context.Context) (context.Context, error) {
+    if !h.breaker.Allow() {
+        return ctx, ErrCircuitOpen
+    }
+    if h.timeout <= 0 {
+        return ctx, nil
+    }
+    ctx, cancel := context.WithTimeout(ctx, h.timeout)
+    return context.WithValue(ctx, cancelKey{}, cancel), nil
+}
+
+func (h callHook) after(ctx context.Context, err error) {
+    if cancel, ok := ctx.Value(cancelKey{}).(context.CancelFunc); ok {
+        cancel()
+    }
+    h.breaker.Record(err)
+}
+
+func (h callHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+    return h.before(ctx)
+}
+
+func (h callHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+    h.after(ctx, cmd.Err())
+    return nil
+}
+
+func (h callHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+    return h.before(ctx)
+}
+
+// AfterProcessPipeline records the first error that is not a missing key
+func (h callHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+    var err error
+    for _, cmd := range cmds {
+        if cmdErr := cmd.Err(); cmdErr != nil && cmdErr != redis.Nil {
+            err = cmdErr
+            break
+        }
+    }
+    h.after(ctx, err)
+    return nil
+}
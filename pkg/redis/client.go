@@ -2,7 +2,13 @@ package redis
 
 import (
     "context"
+    "crypto/sha1"
+    "encoding/hex"
     "fmt"
+    "log"
+    "strings"
+    "sync"
+    "sync/atomic"
     "time"
 
     "github.com/go-redis/redis/v8"
@@ -10,45 +16,224 @@ import (
 )
 
 type Client struct {
-    rdb *redis.Client
+    rdb redis.UniversalClient
+
+    // Scripts loaded through ScriptLoad, by SHA, so they can be loaded
+    // again on servers that have never seen them
+    mu      sync.RWMutex
+    scripts map[string]string
+
+    reloads int64
+
+    breaker *CircuitBreaker
+
+    // Servers of a sharded client, by address
+    shards map[string]*shard
 }
 
+// shard is one server of a sharded client. Each has its own circuit
+// breaker so that a failed shard does not stop the others.
+type shard struct {
+    client  *redis.Client
+    breaker *CircuitBreaker
+}
+
+// Shared by single-node and cluster clients
+const (
+    minIdleConns = 5
+    dialTimeout  = 5 * time.Second
+    readTimeout  = 3 * time.Second
+    writeTimeout = 3 * time.Second
+)
+
 func NewClient(cfg *config.Config) (*Client, error) {
-    rdb := redis.NewClient(&redis.Options{
-        Addr:     fmt.Sprintf("%s:%s", cfg.Redis.Host, cfg.Redis.Port),
-        Password: cfg.Redis.Password,
-        DB:       cfg.Redis.DB,
-        
-        // Connection pool settings
-        PoolSize:     20,
-        MinIdleConns: 5,
-        MaxRetries:   3,
-        
-        // Timeouts
-        DialTimeout:  5 * time.Second,
-        ReadTimeout:  3 * time.Second,
-        WriteTimeout: 3 * time.Second,
-    })
+    c := &Client{
+        scripts: make(map[string]string),
+        breaker: NewCircuitBreaker(cfg.Redis.BreakerThreshold, cfg.Redis.BreakerCooldown),
+    }
+
+    switch {
+    case len(cfg.Redis.ShardAddrs) > 0:
+        // Shards are named by address, so a key stays on its shard however
+        // the list is ordered and adding a shard only moves the keys that
+        // rendezvous hashing gives to it
+        addrs := make(map[string]string, len(cfg.Redis.ShardAddrs))
+        for _, addr := range cfg.Redis.ShardAddrs {
+            addrs[addr] = addr
+        }
+        // Each shard gets its own breaker, so that calls to the other shards
+        // go on while one is down
+        c.breaker = nil
+        c.shards = make(map[string]*shard, len(addrs))
+        c.rdb = redis.NewRing(&redis.RingOptions{
+            Addrs: addrs,
+            NewClient: func(name string, opt *redis.Options) *redis.Client {
+                s := &shard{
+                    client:  redis.NewClient(opt),
+                    breaker: NewCircuitBreaker(cfg.Redis.BreakerThreshold, cfg.Redis.BreakerCooldown),
+                }
+                s.client.AddHook(callHook{breaker: s.breaker})
+                c.shards[name] = s
+                return s.client
+            },
+            Password: cfg.Redis.Password,
+            DB:       cfg.Redis.DB,
+
+            // A shard that restarts has lost our scripts
+            OnConnect: c.loadScripts,
+
+            PoolSize:     cfg.Redis.PoolSize,
+            MinIdleConns: minIdleConns,
+            MaxRetries:   cfg.Redis.MaxRetries,
+
+            DialTimeout:  dialTimeout,
+            ReadTimeout:  readTimeout,
+            WriteTimeout: writeTimeout,
+        })
+    case len(cfg.Redis.ClusterAddrs) > 0:
+        c.rdb = redis.NewClusterClient(&redis.ClusterOptions{
+            Addrs:    cfg.Redis.ClusterAddrs,
+            Password: cfg.Redis.Password,
+
+            PoolSize:     cfg.Redis.PoolSize,
+            MinIdleConns: minIdleConns,
+            MaxRetries:   cfg.Redis.MaxRetries,
+
+            DialTimeout:  dialTimeout,
+            ReadTimeout:  readTimeout,
+            WriteTimeout: writeTimeout,
+        })
+    case len(cfg.Redis.SentinelAddrs) > 0:
+        c.rdb = redis.NewFailoverClient(&redis.FailoverOptions{
+            MasterName:       cfg.Redis.SentinelMaster,
+            SentinelAddrs:    cfg.Redis.SentinelAddrs,
+            SentinelPassword: cfg.Redis.SentinelPassword,
+            Password:         cfg.Redis.Password,
+            DB:               cfg.Redis.DB,
+
+            // After a failover the pool reconnects to the promoted replica,
+            // whose script cache does not have our scripts
+            OnConnect: c.loadScripts,
+
+            PoolSize:     cfg.Redis.PoolSize,
+            MinIdleConns: minIdleConns,
+            MaxRetries:   cfg.Redis.MaxRetries,
+
+            DialTimeout:  dialTimeout,
+            ReadTimeout:  readTimeout,
+            WriteTimeout: writeTimeout,
+        })
+    default:
+        c.rdb = redis.NewClient(&redis.Options{
+            Addr:     fmt.Sprintf("%s:%s", cfg.Redis.Host, cfg.Redis.Port),
+            Password: cfg.Redis.Password,
+            DB:       cfg.Redis.DB,
+
+            // Connection pool settings
+            PoolSize:     cfg.Redis.PoolSize,
+            MinIdleConns: minIdleConns,
+            MaxRetries:   cfg.Redis.MaxRetries,
+
+            // Timeouts
+            DialTimeout:  dialTimeout,
+            ReadTimeout:  readTimeout,
+            WriteTimeout: writeTimeout,
+        })
+    }
+
+    c.rdb.AddHook(callHook{breaker: c.breaker, timeout: cfg.Redis.OpTimeout})
 
     // Test connection with a background context
     ctx := context.Background()
-    if err := rdb.Ping(ctx).Err(); err != nil {
+    if err := c.rdb.Ping(ctx).Err(); err != nil {
+        c.rdb.Close()
         return nil, fmt.Errorf("failed to connect to Redis: %w", err)
     }
 
-    return &Client{
-        rdb: rdb,
-    }, nil
+    return c, nil
+}
+
+// loadScripts loads every registered script over a new connection
+func (c *Client) loadScripts(ctx context.Context, cn *redis.Conn) error {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    for sha, script := range c.scripts {
+        if err := cn.ScriptLoad(ctx, script).Err(); err != nil {
+            return fmt.Errorf("failed to load script %s: %w", sha, err)
+        }
+    }
+    return nil
+}
+
+// CircuitState returns the state of the circuit breaker, or "" when it is
+// disabled. A sharded client reports its least healthy shard.
+func (c *Client) CircuitState() string {
+    if c.shards == nil {
+        return c.breaker.State()
+    }
+    state := ""
+    for _, s := range c.shards {
+        switch s.breaker.State() {
+        case CircuitOpen:
+            return CircuitOpen
+        case CircuitHalfOpen:
+            state = CircuitHalfOpen
+        case CircuitClosed:
+            if state == "" {
+                state = CircuitClosed
+            }
+        }
+    }
+    return state
+}
+
+// ShardHealth pings every shard of a sharded client and returns "healthy"
+// or the error by address. It returns nil for other clients.
+func (c *Client) ShardHealth(ctx context.Context) map[string]string {
+    if c.shards == nil {
+        return nil
+    }
+    health := make(map[string]string, len(c.shards))
+    for addr, s := range c.shards {
+        health[addr] = "healthy"
+        if err := s.client.Ping(ctx).Err(); err != nil {
+            health[addr] = err.Error()
+        }
+    }
+    return health
 }
 
 func (c *Client) Close() error {
     return c.rdb.Close()
 }
 
+// Health pings the server, every master and replica in cluster mode, or
+// every shard of a sharded client
 func (c *Client) Health(ctx context.Context) error {
+    if c.shards != nil {
+        for addr, s := range c.shards {
+            if err := s.client.Ping(ctx).Err(); err != nil {
+                return fmt.Errorf("%s: %w", addr, err)
+            }
+        }
+        return nil
+    }
+    if cluster, ok := c.rdb.(*redis.ClusterClient); ok {
+        return cluster.ForEachShard(ctx, func(ctx context.Context, shard *redis.Client) error {
+            if err := shard.Ping(ctx).Err(); err != nil {
+                return fmt.Errorf("%s: %w", shard.Options().Addr, err)
+            }
+            return nil
+        })
+    }
     return c.rdb.Ping(ctx).Err()
 }
 
+func (c *Client) Del(ctx context.Context, keys ...string) error {
+    return c.rdb.Del(ctx, keys...).Err()
+}
+
 // Get current count for a key
 func (c *Client) GetCount(ctx context.Context, key string) (int64, error) {
     val, err := c.rdb.Get(ctx, key).Int64()
@@ -60,9 +245,14 @@ func (c *Client) GetCount(ctx context.Context, key string) (int64, error) {
 
 // Increment counter with expiration
 func (c *Client) IncrementWithExpiry(ctx context.Context, key string, expiry time.Duration) (int64, error) {
+    return c.IncrementByWithExpiry(ctx, key, 1, expiry)
+}
+
+// Increment counter by n with expiration; n may be negative
+func (c *Client) IncrementByWithExpiry(ctx context.Context, key string, n int64, expiry time.Duration) (int64, error) {
     pipe := c.rdb.Pipeline()
     
-    incr := pipe.Incr(ctx, key)
+    incr := pipe.IncrBy(ctx, key, n)
     pipe.Expire(ctx, key, expiry)
     
     _, err := pipe.Exec(ctx)
@@ -89,15 +279,120 @@ func (c *Client) ZCard(ctx context.Context, key string) (int64, error) {
     return c.rdb.ZCard(ctx, key).Result()
 }
 
+func (c *Client) ZCount(ctx context.Context, key string, min, max string) (int64, error) {
+    return c.rdb.ZCount(ctx, key, min, max).Result()
+}
+
+// ZScoresByScore returns the scores of up to count members within
+// [min, max], skipping the first offset
+func (c *Client) ZScoresByScore(ctx context.Context, key string, min, max string, offset, count int64) ([]float64, error) {
+    zs, err := c.rdb.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+        Min:    min,
+        Max:    max,
+        Offset: offset,
+        Count:  count,
+    }).Result()
+    if err != nil {
+        return nil, err
+    }
+    scores := make([]float64, len(zs))
+    for i, z := range zs {
+        scores[i] = z.Score
+    }
+    return scores, nil
+}
+
 func (c *Client) ZExpire(ctx context.Context, key string, expiry time.Duration) error {
     return c.rdb.Expire(ctx, key, expiry).Err()
 }
 
-// Lua script execution for atomic operations
+// Lua script execution for atomic operations. If the server no longer has
+// the script, because it restarted, failed over or had its cache flushed,
+// the script is run once with EVAL, which also loads it again.
 func (c *Client) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) (interface{}, error) {
-    return c.rdb.EvalSha(ctx, sha1, keys, args...).Result()
+    result, err := c.rdb.EvalSha(ctx, sha1, keys, args...).Result()
+    if err == nil || !strings.HasPrefix(err.Error(), "NOSCRIPT") {
+        return result, err
+    }
+
+    c.mu.RLock()
+    script, ok := c.scripts[sha1]
+    c.mu.RUnlock()
+    if !ok {
+        return nil, err
+    }
+
+    // EVAL is routed by its keys like EVALSHA, so it caches the script on
+    // the server or shard that lost it. A keyless SCRIPT LOAD would go to a
+    // random shard of a sharded client.
+    atomic.AddInt64(&c.reloads, 1)
+    log.Printf("Redis script %s missing, reloading", sha1)
+    return c.rdb.Eval(ctx, script, keys, args...).Result()
 }
 
+// ScriptCall is one EvalSha invocation in EvalShaBatch
+type ScriptCall struct {
+    SHA  string
+    Keys []string
+    Args []interface{}
+}
+
+// ScriptResult is the reply to one ScriptCall
+type ScriptResult struct {
+    Value interface{}
+    Err   error
+}
+
+// EvalShaBatch runs the calls in one pipeline and returns their results in
+// order. A failed call does not affect the others; calls whose script is
+// missing are retried one by one through EvalSha.
+func (c *Client) EvalShaBatch(ctx context.Context, calls []ScriptCall) []ScriptResult {
+    pipe := c.rdb.Pipeline()
+    cmds := make([]*redis.Cmd, len(calls))
+    for i, call := range calls {
+        cmds[i] = pipe.EvalSha(ctx, call.SHA, call.Keys, call.Args...)
+    }
+    // Exec reports the first failed command; each is checked below
+    pipe.Exec(ctx)
+
+    results := make([]ScriptResult, len(calls))
+    for i, cmd := range cmds {
+        value, err := cmd.Result()
+        if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+            value, err = c.EvalSha(ctx, calls[i].SHA, calls[i].Keys, calls[i].Args...)
+        }
+        results[i] = ScriptResult{Value: value, Err: err}
+    }
+    return results
+}
+
+// ScriptReloads returns how many times EvalSha found a script missing
+func (c *Client) ScriptReloads() int64 {
+    return atomic.LoadInt64(&c.reloads)
+}
+
+// ScriptLoad loads the script on the server, or on every node in cluster
+// mode and every live shard of a sharded client so that EvalSha works
+// wherever the keys hash to. The script is remembered and loaded again on a
+// new master after a Sentinel failover, or on a shard that comes back.
 func (c *Client) ScriptLoad(ctx context.Context, script string) (string, error) {
-    return c.rdb.ScriptLoad(ctx, script).Result()
+    var sha string
+    var err error
+    if ring, ok := c.rdb.(*redis.Ring); ok {
+        err = ring.ForEachShard(ctx, func(ctx context.Context, shard *redis.Client) error {
+            return shard.ScriptLoad(ctx, script).Err()
+        })
+        sum := sha1.Sum([]byte(script))
+        sha = hex.EncodeToString(sum[:])
+    } else {
+        sha, err = c.rdb.ScriptLoad(ctx, script).Result()
+    }
+    if err != nil {
+        return "", err
+    }
+
+    c.mu.Lock()
+    c.scripts[sha] = script
+    c.mu.Unlock()
+    return sha, nil
 }
\ No newline at end of file
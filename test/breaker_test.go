@@ -0,0 +1,53 @@
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/pkg/redis"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := redis.NewCircuitBreaker(3, 20*time.Millisecond)
+	errTimeout := errors.New("i/o timeout")
+
+	for i := 0; i < 3; i++ {
+		if !cb.Allow() {
+			t.Fatalf("Call %d should be allowed while closed", i)
+		}
+		cb.Record(errTimeout)
+	}
+	if cb.State() != redis.CircuitOpen {
+		t.Fatalf("Expected open after 3 failures, got %s", cb.State())
+	}
+	if cb.Allow() {
+		t.Error("Calls should fail fast while open")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !cb.Allow() {
+		t.Fatal("One probe should be allowed after the cooldown")
+	}
+	if cb.State() != redis.CircuitHalfOpen {
+		t.Errorf("Expected half-open while probing, got %s", cb.State())
+	}
+	if cb.Allow() {
+		t.Error("Only one probe should be allowed at a time")
+	}
+	cb.Record(errTimeout)
+	if cb.State() != redis.CircuitOpen {
+		t.Errorf("A failed probe should reopen the circuit, got %s", cb.State())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	cb.Allow()
+	cb.Record(nil)
+	if cb.State() != redis.CircuitClosed || !cb.Allow() {
+		t.Errorf("A successful probe should close the circuit, got %s", cb.State())
+	}
+
+	if disabled := redis.NewCircuitBreaker(0, time.Second); !disabled.Allow() || disabled.State() != "" {
+		t.Error("A disabled breaker should always allow")
+	}
+}
@@ -0,0 +1,235 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	limiter "github.com/mshort2/distributed-rate-limiter/pkg/ratelimiter"
+)
+
+// fakeClock is a limiter.Clock that only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestClockWindows(t *testing.T) {
+	ctx := context.Background()
+	limiters := map[string]func(*fakeClock) (limiter.Limiter, error){
+		limiter.AlgorithmSlidingLog: func(clock *fakeClock) (limiter.Limiter, error) {
+			l, err := limiter.NewRateLimiter(memoryConfig(), 3, time.Minute)
+			if err == nil {
+				l.Clock = clock
+			}
+			return l, err
+		},
+		limiter.AlgorithmSlidingWindow: func(clock *fakeClock) (limiter.Limiter, error) {
+			l, err := limiter.NewSlidingWindowCounterLimiter(memoryConfig(), 3, time.Minute)
+			if err == nil {
+				l.Clock = clock
+			}
+			return l, err
+		},
+		limiter.AlgorithmFixedWindow: func(clock *fakeClock) (limiter.Limiter, error) {
+			l, err := limiter.NewFixedWindowLimiter(memoryConfig(), 3, time.Minute)
+			if err == nil {
+				l.Clock = clock
+			}
+			return l, err
+		},
+		limiter.AlgorithmTokenBucket: func(clock *fakeClock) (limiter.Limiter, error) {
+			l, err := limiter.NewTokenBucketLimiter(memoryConfig(), 3.0/60, 3)
+			if err == nil {
+				l.Clock = clock
+			}
+			return l, err
+		},
+		limiter.AlgorithmGCRA: func(clock *fakeClock) (limiter.Limiter, error) {
+			l, err := limiter.NewGCRALimiter(memoryConfig(), 3, time.Minute)
+			if err == nil {
+				l.Clock = clock
+			}
+			return l, err
+		},
+	}
+
+	for algorithm, newLimiter := range limiters {
+		t.Run(algorithm, func(t *testing.T) {
+			clock := newFakeClock()
+			rl, err := newLimiter(clock)
+			if err != nil {
+				t.Fatalf("Failed to create limiter: %v", err)
+			}
+			defer rl.Close()
+
+			for i := 0; i < 4; i++ {
+				resp, err := rl.Allow(ctx, "clock", "")
+				if err != nil {
+					t.Fatalf("Request %d failed: %v", i, err)
+				}
+				if resp.Allowed != (i < 3) {
+					t.Errorf("Request %d: expected allowed=%v", i, i < 3)
+				}
+			}
+
+			// Two windows so that the sliding window counter forgets the
+			// previous one too
+			clock.Advance(2 * time.Minute)
+			resp, err := rl.Allow(ctx, "clock", "")
+			if err != nil {
+				t.Fatalf("Request after the window failed: %v", err)
+			}
+			if !resp.Allowed {
+				t.Error("Request after the window should be allowed")
+			}
+		})
+	}
+}
+
+func TestTimeSourceConfig(t *testing.T) {
+	cfg := memoryConfig()
+	cfg.RateLimit.TimeSource = limiter.TimeRedis
+
+	rl, err := limiter.NewRateLimiter(cfg, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer rl.Close()
+	if resp, err := rl.Allow(context.Background(), "server-time", ""); err != nil || !resp.Allowed {
+		t.Errorf("Request with the store clock should be allowed: %v", err)
+	}
+
+	fw, err := limiter.NewFixedWindowLimiter(cfg, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected the fixed window limiter to accept the redis time source: %v", err)
+	}
+	fw.Close()
+
+	cfg.RateLimit.TimeSource = "sundial"
+	if _, err := limiter.NewRateLimiter(cfg, 1, time.Minute); err == nil {
+		t.Error("Expected an unknown time source to be rejected")
+	}
+}
+
+func TestTimeSourcePeek(t *testing.T) {
+	ctx := context.Background()
+	cfg := memoryConfig()
+	cfg.RateLimit.TimeSource = limiter.TimeRedis
+
+	rl, err := limiter.NewRateLimiter(cfg, 2, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer rl.Close()
+
+	// This node's clock runs two windows ahead of the store's
+	clock := newFakeClock()
+	clock.Advance(2 * time.Minute)
+	rl.Clock = clock
+
+	for i := 0; i < 2; i++ {
+		if resp, err := rl.Allow(ctx, "skewed", ""); err != nil || !resp.Allowed {
+			t.Fatalf("Request %d should be allowed: %v", i, err)
+		}
+	}
+
+	peek, err := rl.Peek(ctx, "skewed")
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if peek.Allowed || peek.Remaining != 0 {
+		t.Errorf("Peek expected denied with 0 remaining, got allowed=%v remaining=%d", peek.Allowed, peek.Remaining)
+	}
+	if reset := time.Until(peek.ResetTime); reset <= 0 || reset > time.Minute {
+		t.Errorf("Expected a reset within a minute of the store's clock, got %v", reset)
+	}
+}
+
+// TestTimeSourceResponses checks that limiters report times from the
+// store's clock rather than a skewed node clock.
+func TestTimeSourceResponses(t *testing.T) {
+	ctx := context.Background()
+	cfg := memoryConfig()
+	cfg.RateLimit.TimeSource = limiter.TimeRedis
+
+	clock := newFakeClock()
+	clock.Advance(time.Hour)
+	limiters := map[string]func() (limiter.Limiter, error){
+		limiter.AlgorithmFixedWindow: func() (limiter.Limiter, error) {
+			l, err := limiter.NewFixedWindowLimiter(cfg, 60, time.Minute)
+			if err == nil {
+				l.Clock = clock
+			}
+			return l, err
+		},
+		limiter.AlgorithmSlidingWindow: func() (limiter.Limiter, error) {
+			l, err := limiter.NewSlidingWindowCounterLimiter(cfg, 60, time.Minute)
+			if err == nil {
+				l.Clock = clock
+			}
+			return l, err
+		},
+		"leasing": func() (limiter.Limiter, error) {
+			cfg := *cfg
+			cfg.RateLimit.LeaseSize = 10
+			l, err := limiter.NewLeasingLimiter(&cfg, 60, time.Minute)
+			if err == nil {
+				l.Clock = clock
+			}
+			return l, err
+		},
+		limiter.AlgorithmTokenBucket: func() (limiter.Limiter, error) {
+			l, err := limiter.NewTokenBucketLimiter(cfg, 1, 60)
+			if err == nil {
+				l.Clock = clock
+			}
+			return l, err
+		},
+		limiter.AlgorithmGCRA: func() (limiter.Limiter, error) {
+			l, err := limiter.NewGCRALimiter(cfg, 60, time.Minute)
+			if err == nil {
+				l.Clock = clock
+			}
+			return l, err
+		},
+	}
+
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			rl, err := newLimiter()
+			if err != nil {
+				t.Fatalf("Failed to create limiter: %v", err)
+			}
+			defer rl.Close()
+
+			resp, err := rl.Allow(ctx, "skewed", "")
+			if err != nil || !resp.Allowed {
+				t.Fatalf("Request should be allowed: %v", err)
+			}
+			if reset := time.Until(resp.ResetTime); reset <= 0 || reset > time.Minute {
+				t.Errorf("Expected a reset within a minute of the store's clock, got %v", reset)
+			}
+			if start := time.Since(resp.WindowStart); start < 0 || start > 2*time.Minute {
+				t.Errorf("Expected a window start within the store's last window, got %v ago", start)
+			}
+		})
+	}
+}
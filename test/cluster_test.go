@@ -0,0 +1,69 @@
+package test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+	"github.com/mshort2/distributed-rate-limiter/internal/middleware"
+	limiter "github.com/mshort2/distributed-rate-limiter/pkg/ratelimiter"
+)
+
+// TestClusterMultiKeyScripts runs the limiters whose scripts touch several
+// keys against a Redis Cluster; start one with `make cluster-up`.
+func TestClusterMultiKeyScripts(t *testing.T) {
+	if os.Getenv("REDIS_CLUSTER_ADDRS") == "" {
+		t.Skip("REDIS_CLUSTER_ADDRS not set")
+	}
+	cfg := config.Load()
+	ctx := context.Background()
+
+	ml, err := limiter.NewMultiLimiter(cfg,
+		limiter.Rule{Limit: 2, Window: time.Minute},
+		limiter.Rule{Limit: 10, Window: time.Hour},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create multi limiter: %v", err)
+	}
+	defer ml.Close()
+
+	sl, err := limiter.NewRateLimiter(cfg, 2, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create sliding window limiter: %v", err)
+	}
+	defer sl.Close()
+
+	// Spread keys over many slots so every node runs the scripts
+	for i := 0; i < 20; i++ {
+		clientID := "cluster-client-" + middleware.GenerateRequestID()
+
+		for _, rl := range []limiter.Limiter{ml, sl} {
+			if err := rl.Reset(ctx, clientID); err != nil {
+				t.Fatalf("Reset %s failed: %v", clientID, err)
+			}
+			for j := 0; j < 3; j++ {
+				resp, err := rl.Allow(ctx, clientID, middleware.GenerateRequestID())
+				if err != nil {
+					t.Fatalf("%T request %d for %s failed: %v", rl, j, clientID, err)
+				}
+				if resp.Allowed != (j < 2) {
+					t.Errorf("%T request %d for %s: expected allowed=%v", rl, j, clientID, j < 2)
+				}
+			}
+		}
+
+		hold, err := sl.Hold(ctx, clientID+"-hold", 1, time.Minute)
+		if err != nil {
+			t.Fatalf("Hold for %s failed: %v", clientID, err)
+		}
+		if _, err := sl.Cancel(ctx, clientID+"-hold", hold.ID); err != nil {
+			t.Fatalf("Cancel for %s failed: %v", clientID, err)
+		}
+	}
+
+	if err := ml.Health(ctx); err != nil {
+		t.Errorf("Cluster health check failed: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+	"github.com/mshort2/distributed-rate-limiter/internal/server"
+	limiter "github.com/mshort2/distributed-rate-limiter/pkg/ratelimiter"
+)
+
+// countingLimiter is a fakeLimiter that counts the checks reaching it.
+type countingLimiter struct {
+	*fakeLimiter
+	calls int
+}
+
+func (c *countingLimiter) Allow(ctx context.Context, key string, requestID string) (limiter.RateLimitResponse, error) {
+	return c.AllowN(ctx, key, requestID, 1)
+}
+
+func (c *countingLimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (limiter.RateLimitResponse, error) {
+	c.calls++
+	return c.fakeLimiter.AllowN(ctx, key, requestID, cost)
+}
+
+func TestDenyCache(t *testing.T) {
+	ctx := context.Background()
+	primary := &countingLimiter{fakeLimiter: newFakeLimiter(2)}
+	rl := limiter.NewDenyCache(primary, 10)
+
+	for i := 0; i < 5; i++ {
+		resp, err := rl.Allow(ctx, "abusive", "")
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if resp.Allowed != (i < 2) {
+			t.Errorf("Request %d: expected allowed=%v", i, i < 2)
+		}
+		if !resp.Allowed && resp.RetryAfterMs <= 0 {
+			t.Errorf("Request %d: expected a retry hint, got %d", i, resp.RetryAfterMs)
+		}
+	}
+	if primary.calls != 3 {
+		t.Errorf("Expected denied requests to be answered from the cache, got %d limiter calls", primary.calls)
+	}
+
+	if resp, _ := rl.Allow(ctx, "other", ""); !resp.Allowed {
+		t.Error("Other keys should not be affected by the cache")
+	}
+
+	stats := rl.(limiter.DenyCacheReporter).DenyCacheStats()
+	if stats.Hits != 2 || stats.Misses != 4 || stats.Entries != 1 {
+		t.Errorf("Expected 2 hits, 4 misses and 1 entry, got %+v", stats)
+	}
+
+	if err := rl.Reset(ctx, "abusive"); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if resp, _ := rl.Allow(ctx, "abusive", ""); !resp.Allowed {
+		t.Error("Request after reset should be allowed")
+	}
+
+	srv := server.NewServerWithLimiter(config.Load(), rl)
+	req, err := http.NewRequest("GET", "/admin/stats", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+
+	var body struct {
+		DenyCache *limiter.DenyCacheStats `json:"deny_cache"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if body.DenyCache == nil || body.DenyCache.HitRate <= 0 {
+		t.Errorf("Expected deny cache stats with a hit rate, got %s", rr.Body.String())
+	}
+}
+
+// TestDenyCacheSettledHold checks that giving back held units forgets the
+// denial they caused.
+func TestDenyCacheSettledHold(t *testing.T) {
+	ctx := context.Background()
+	sl, err := limiter.NewRateLimiter(memoryConfig(), 2, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	rl := limiter.NewDenyCache(sl, 10)
+	defer rl.Close()
+	hl := rl.(limiter.HoldLimiter)
+
+	for _, settle := range []string{"commit", "cancel"} {
+		hold, err := hl.Hold(ctx, "held", 2, time.Minute)
+		if err != nil || !hold.Allowed {
+			t.Fatalf("Hold should succeed: %v", err)
+		}
+		if resp, err := rl.Allow(ctx, "held", ""); err != nil || resp.Allowed {
+			t.Fatalf("Request during the hold should be denied: %v", err)
+		}
+
+		if settle == "commit" {
+			_, err = hl.Commit(ctx, "held", hold.ID, 0)
+		} else {
+			_, err = hl.Cancel(ctx, "held", hold.ID)
+		}
+		if err != nil {
+			t.Fatalf("%s failed: %v", settle, err)
+		}
+		if resp, err := rl.Allow(ctx, "held", ""); err != nil || !resp.Allowed {
+			t.Errorf("Request after %s should be allowed: %v", settle, err)
+		}
+		if err := rl.Reset(ctx, "held"); err != nil {
+			t.Fatalf("Reset failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	limiter "github.com/mshort2/distributed-rate-limiter/pkg/ratelimiter"
+)
+
+// flakyLimiter is a fakeLimiter whose store can be taken down.
+type flakyLimiter struct {
+	*fakeLimiter
+	down bool
+}
+
+var errStoreDown = errors.New("connection refused")
+
+func (f *flakyLimiter) Allow(ctx context.Context, key string, requestID string) (limiter.RateLimitResponse, error) {
+	return f.AllowN(ctx, key, requestID, 1)
+}
+
+func (f *flakyLimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (limiter.RateLimitResponse, error) {
+	if f.down {
+		return limiter.RateLimitResponse{}, errStoreDown
+	}
+	return f.fakeLimiter.AllowN(ctx, key, requestID, cost)
+}
+
+func (f *flakyLimiter) Peek(ctx context.Context, key string) (limiter.RateLimitResponse, error) {
+	if f.down {
+		return limiter.RateLimitResponse{}, errStoreDown
+	}
+	return f.fakeLimiter.Peek(ctx, key)
+}
+
+func TestFailoverLimiterPolicies(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("fail open allows", func(t *testing.T) {
+		cfg := memoryConfig()
+		cfg.RateLimit.FailurePolicy = limiter.FailureOpen
+		rl, err := limiter.NewFailoverLimiter(cfg, &flakyLimiter{fakeLimiter: newFakeLimiter(1), down: true})
+		if err != nil {
+			t.Fatalf("Failed to create limiter: %v", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			resp, err := rl.Allow(ctx, "open-client", "")
+			if err != nil {
+				t.Fatalf("Request %d failed: %v", i, err)
+			}
+			if !resp.Allowed || !resp.Degraded {
+				t.Errorf("Request %d: expected allowed and degraded, got %+v", i, resp)
+			}
+		}
+	})
+
+	t.Run("fail closed denies", func(t *testing.T) {
+		cfg := memoryConfig()
+		cfg.RateLimit.FailurePolicy = limiter.FailureClosed
+		rl, err := limiter.NewFailoverLimiter(cfg, &flakyLimiter{fakeLimiter: newFakeLimiter(1), down: true})
+		if err != nil {
+			t.Fatalf("Failed to create limiter: %v", err)
+		}
+
+		resp, err := rl.Allow(ctx, "closed-client", "")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if resp.Allowed || !resp.Degraded || resp.RetryAfterMs <= 0 {
+			t.Errorf("Expected denied and degraded with a retry hint, got %+v", resp)
+		}
+	})
+
+	t.Run("local fallback divides the limit and recovers", func(t *testing.T) {
+		cfg := memoryConfig()
+		cfg.RateLimit.FailurePolicy = limiter.FailureLocal
+		cfg.RateLimit.DefaultLimit = 4
+		cfg.RateLimit.NodeCount = 2
+		primary := &flakyLimiter{fakeLimiter: newFakeLimiter(4), down: true}
+		rl, err := limiter.NewFailoverLimiter(cfg, primary)
+		if err != nil {
+			t.Fatalf("Failed to create limiter: %v", err)
+		}
+		defer rl.Close()
+
+		for i := 0; i < 3; i++ {
+			resp, err := rl.Allow(ctx, "local-client", "")
+			if err != nil {
+				t.Fatalf("Request %d failed: %v", i, err)
+			}
+			if !resp.Degraded {
+				t.Errorf("Request %d should be degraded", i)
+			}
+			if resp.Allowed != (i < 2) {
+				t.Errorf("Request %d: expected allowed=%v with half the limit", i, i < 2)
+			}
+		}
+
+		primary.down = false
+		resp, err := rl.Allow(ctx, "local-client", "")
+		if err != nil {
+			t.Fatalf("Request after recovery failed: %v", err)
+		}
+		if resp.Degraded || !resp.Allowed || resp.Remaining != 3 {
+			t.Errorf("Expected the primary to decide after recovery, got %+v", resp)
+		}
+	})
+
+	t.Run("batch applies the policy per check", func(t *testing.T) {
+		cfg := memoryConfig()
+		cfg.RateLimit.FailurePolicy = limiter.FailureOpen
+		rl, err := limiter.NewFailoverLimiter(cfg, &flakyLimiter{fakeLimiter: newFakeLimiter(1), down: true})
+		if err != nil {
+			t.Fatalf("Failed to create limiter: %v", err)
+		}
+
+		results := limiter.AllowBatch(ctx, rl, []limiter.Check{
+			{Key: "batch-a", Cost: 1},
+			{Key: "batch-b", Cost: -1},
+		})
+		if results[0].Err != nil || !results[0].Response.Allowed || !results[0].Response.Degraded {
+			t.Errorf("Expected the first check allowed and degraded, got %+v", results[0])
+		}
+		if results[1].Err == nil {
+			t.Error("Expected an error for a negative cost")
+		}
+	})
+
+	t.Run("invalid cost is not degraded", func(t *testing.T) {
+		cfg := memoryConfig()
+		cfg.RateLimit.FailurePolicy = limiter.FailureOpen
+		rl, err := limiter.NewFailoverLimiter(cfg, &flakyLimiter{fakeLimiter: newFakeLimiter(1), down: true})
+		if err != nil {
+			t.Fatalf("Failed to create limiter: %v", err)
+		}
+		if _, err := rl.AllowN(ctx, "open-client", "", 0); err == nil {
+			t.Error("Expected an error for a zero cost")
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	limiter "github.com/mshort2/distributed-rate-limiter/pkg/ratelimiter"
+)
+
+// newLeasingNodes creates limiters that share one memory store, like nodes
+// sharing a Redis instance.
+func newLeasingNodes(t *testing.T, n int, ttl time.Duration) []*limiter.LeasingLimiter {
+	cfg := memoryConfig()
+	cfg.RateLimit.LeaseSize = 4
+	cfg.RateLimit.LeaseTTL = ttl
+
+	nodes := make([]*limiter.LeasingLimiter, n)
+	for i := range nodes {
+		l, err := limiter.NewLeasingLimiter(cfg, 10, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to create leasing limiter: %v", err)
+		}
+		if i > 0 {
+			l.Store.Close()
+			l.Store = nodes[0].Store
+		}
+		nodes[i] = l
+	}
+	return nodes
+}
+
+func TestLeasingLimiterNeverOverAdmits(t *testing.T) {
+	ctx := context.Background()
+	nodes := newLeasingNodes(t, 2, time.Hour)
+	a, b := nodes[0], nodes[1]
+	defer a.Close()
+	defer b.Close()
+
+	if resp, err := a.Allow(ctx, "hot", ""); err != nil || !resp.Allowed {
+		t.Fatalf("First request should be allowed: %v", err)
+	}
+	if peek, _ := b.Peek(ctx, "hot"); peek.Remaining != 6 {
+		t.Errorf("Expected the whole lease to be charged, got remaining %d", peek.Remaining)
+	}
+
+	admitted := 1
+	for _, node := range []*limiter.LeasingLimiter{b, a} {
+		for {
+			resp, err := node.Allow(ctx, "hot", "")
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			if !resp.Allowed {
+				if resp.RetryAfterMs <= 0 {
+					t.Errorf("Expected a retry hint, got %d", resp.RetryAfterMs)
+				}
+				break
+			}
+			admitted++
+		}
+	}
+	if admitted != 10 {
+		t.Errorf("Expected exactly 10 admitted across nodes, got %d", admitted)
+	}
+}
+
+func TestLeasingLimiterReturnsUnusedUnits(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("on close", func(t *testing.T) {
+		nodes := newLeasingNodes(t, 2, time.Hour)
+		defer nodes[1].Close()
+
+		if _, err := nodes[0].Allow(ctx, "closing", ""); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		nodes[0].Close()
+		if peek, _ := nodes[1].Peek(ctx, "closing"); peek.Remaining != 9 {
+			t.Errorf("Expected unused units back after close, got remaining %d", peek.Remaining)
+		}
+	})
+
+	t.Run("on expiry", func(t *testing.T) {
+		nodes := newLeasingNodes(t, 1, 20*time.Millisecond)
+		defer nodes[0].Close()
+
+		if _, err := nodes[0].Allow(ctx, "expiring", ""); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if peek, _ := nodes[0].Peek(ctx, "expiring"); peek.Remaining != 9 {
+			t.Errorf("Expected unused units back after expiry, got remaining %d", peek.Remaining)
+		}
+	})
+}
+
+func TestLeasingLimiterResetWithOutstandingLease(t *testing.T) {
+	ctx := context.Background()
+	nodes := newLeasingNodes(t, 2, time.Hour)
+	a, b := nodes[0], nodes[1]
+	defer b.Close()
+
+	// a leases 4 units and spends 1, then b resets the key
+	if _, err := a.Allow(ctx, "reset-lease", ""); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if err := b.Reset(ctx, "reset-lease"); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	a.Close()
+
+	if peek, _ := b.Peek(ctx, "reset-lease"); peek.Remaining != 10 {
+		t.Errorf("Expected the reset counter untouched by the release, got remaining %d", peek.Remaining)
+	}
+	admitted := 0
+	for i := 0; i < 12; i++ {
+		resp, err := b.Allow(ctx, "reset-lease", "")
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if resp.Allowed {
+			admitted++
+		}
+	}
+	if admitted != 10 {
+		t.Errorf("Expected exactly 10 admitted after the reset, got %d", admitted)
+	}
+}
+
+func TestLeasingLimiterReleaseAfterRecharge(t *testing.T) {
+	ctx := context.Background()
+	nodes := newLeasingNodes(t, 2, time.Hour)
+	a, b := nodes[0], nodes[1]
+	defer b.Close()
+
+	// a leases 4 units and spends 1, then b resets the key and leases from
+	// the new counter before a gives its 3 units back
+	if _, err := a.Allow(ctx, "recharged", ""); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if err := b.Reset(ctx, "recharged"); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if _, err := b.Allow(ctx, "recharged", ""); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	a.Close()
+
+	if peek, _ := b.Peek(ctx, "recharged"); peek.Remaining != 6 {
+		t.Errorf("Expected the new counter to keep b's lease, got remaining %d", peek.Remaining)
+	}
+}
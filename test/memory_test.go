@@ -0,0 +1,438 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+	limiter "github.com/mshort2/distributed-rate-limiter/pkg/ratelimiter"
+)
+
+func memoryConfig() *config.Config {
+	cfg := config.Load()
+	cfg.Store.Backend = limiter.StoreMemory
+	return cfg
+}
+
+func TestMemoryStoreAlgorithms(t *testing.T) {
+	ctx := context.Background()
+	algorithms := []string{
+		limiter.AlgorithmSlidingLog,
+		limiter.AlgorithmSlidingWindow,
+		limiter.AlgorithmFixedWindow,
+		limiter.AlgorithmTokenBucket,
+		limiter.AlgorithmGCRA,
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			rl, err := limiter.NewFromPolicy(memoryConfig(), limiter.Policy{
+				Algorithm: algorithm,
+				Limit:     5,
+				Window:    time.Hour,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create limiter: %v", err)
+			}
+			defer rl.Close()
+
+			clientID := "memory-" + algorithm
+			for i := 0; i < 5; i++ {
+				resp, err := rl.Allow(ctx, clientID, "")
+				if err != nil {
+					t.Fatalf("Request %d failed: %v", i, err)
+				}
+				if !resp.Allowed {
+					t.Fatalf("Request %d should be allowed", i)
+				}
+				if resp.Remaining != 4-i {
+					t.Errorf("Request %d: expected remaining %d, got %d", i, 4-i, resp.Remaining)
+				}
+			}
+
+			resp, err := rl.Allow(ctx, clientID, "")
+			if err != nil {
+				t.Fatalf("Request over limit failed: %v", err)
+			}
+			if resp.Allowed {
+				t.Error("Request over limit should be denied")
+			}
+			if resp.RetryAfterMs <= 0 {
+				t.Errorf("Expected a retry hint, got %d", resp.RetryAfterMs)
+			}
+
+			peek, err := rl.Peek(ctx, clientID)
+			if err != nil {
+				t.Fatalf("Peek failed: %v", err)
+			}
+			if peek.Allowed || peek.Remaining != 0 {
+				t.Errorf("Peek expected denied with 0 remaining, got allowed=%v remaining=%d", peek.Allowed, peek.Remaining)
+			}
+
+			if err := rl.Reset(ctx, clientID); err != nil {
+				t.Fatalf("Reset failed: %v", err)
+			}
+			if resp, err := rl.Allow(ctx, clientID, ""); err != nil || !resp.Allowed {
+				t.Errorf("Request after reset should be allowed: %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreMultiKeyLimiters(t *testing.T) {
+	ctx := context.Background()
+
+	ml, err := limiter.NewMultiLimiter(memoryConfig(),
+		limiter.Rule{Limit: 2, Window: time.Minute},
+		limiter.Rule{Limit: 3, Window: time.Hour},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create multi limiter: %v", err)
+	}
+	defer ml.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := ml.Allow(ctx, "multi", "")
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if resp.Allowed != (i < 2) {
+			t.Errorf("Request %d: expected allowed=%v", i, i < 2)
+		}
+	}
+
+	hl, err := limiter.NewHierarchicalLimiter(memoryConfig(),
+		limiter.Rule{Limit: 2, Window: time.Minute},
+		limiter.Rule{Limit: 3, Window: time.Minute},
+		limiter.Rule{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create hierarchical limiter: %v", err)
+	}
+	defer hl.Close()
+
+	for i, user := range []string{"alice", "alice", "bob", "bob"} {
+		resp, err := hl.AllowScoped(ctx, limiter.Scope{Org: "acme", User: user}, "", 1)
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if resp.Allowed != (i < 3) {
+			t.Errorf("Request %d: expected allowed=%v", i, i < 3)
+		}
+		if i == 3 && resp.ViolatedLimit != limiter.ScopeOrg {
+			t.Errorf("Expected the org limit to be violated, got %q", resp.ViolatedLimit)
+		}
+	}
+}
+
+func TestMemoryStoreHierarchicalSharedRequestID(t *testing.T) {
+	ctx := context.Background()
+	hl, err := limiter.NewHierarchicalLimiter(memoryConfig(),
+		limiter.Rule{Limit: 5, Window: time.Minute},
+		limiter.Rule{Limit: 10, Window: time.Minute},
+		limiter.Rule{Limit: 10, Window: time.Minute},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create hierarchical limiter: %v", err)
+	}
+	defer hl.Close()
+
+	// Two users of one org send the same request ID
+	for _, user := range []string{"carol", "dave"} {
+		resp, err := hl.AllowScoped(ctx, limiter.Scope{Org: "initech", User: user}, "shared-id", 1)
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", user, err)
+		}
+		if !resp.Allowed || resp.Duplicate {
+			t.Errorf("Request for %s should be allowed and not a duplicate, got %+v", user, resp)
+		}
+	}
+
+	peek, err := hl.PeekScoped(ctx, limiter.Scope{Org: "initech", User: "erin"})
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	for _, status := range peek.Limits {
+		if status.Name != limiter.ScopeUser && status.Remaining != 8 {
+			t.Errorf("Expected both requests charged to %s, got %d remaining", status.Name, status.Remaining)
+		}
+	}
+
+	// A retry by the same user is still recognized
+	resp, err := hl.AllowScoped(ctx, limiter.Scope{Org: "initech", User: "dave"}, "shared-id", 1)
+	if err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	if !resp.Duplicate {
+		t.Errorf("Expected the retry to be a duplicate, got %+v", resp)
+	}
+}
+
+// TestMemoryStoreMultiRetryBetweenWindows retries a request once the short
+// window has let it go but the long one still counts it.
+func TestMemoryStoreMultiRetryBetweenWindows(t *testing.T) {
+	ctx := context.Background()
+	ml, err := limiter.NewMultiLimiter(memoryConfig(),
+		limiter.Rule{Limit: 2, Window: time.Minute},
+		limiter.Rule{Limit: 5, Window: time.Hour},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create multi limiter: %v", err)
+	}
+	defer ml.Close()
+	clock := newFakeClock()
+	ml.Clock = clock
+
+	if resp, err := ml.Allow(ctx, "multi-retry", "req-1"); err != nil || !resp.Allowed {
+		t.Fatalf("Request should be allowed: %v", err)
+	}
+	clock.Advance(2 * time.Minute)
+
+	retry, err := ml.Allow(ctx, "multi-retry", "req-1")
+	if err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	if !retry.Allowed || !retry.Duplicate {
+		t.Errorf("Retry should be an allowed duplicate, got allowed=%v duplicate=%v", retry.Allowed, retry.Duplicate)
+	}
+	if len(retry.Limits) != 2 || retry.Limits[1].Remaining != 4 {
+		t.Errorf("Expected the retry not to be charged again, got %+v", retry.Limits)
+	}
+}
+
+func TestMemoryStoreHoldsAndIdempotency(t *testing.T) {
+	ctx := context.Background()
+	rl, err := limiter.NewRateLimiter(memoryConfig(), 5, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer rl.Close()
+
+	hold, err := rl.Hold(ctx, "holds", 4, time.Minute)
+	if err != nil || !hold.Allowed {
+		t.Fatalf("Hold should succeed: %v", err)
+	}
+	if released, err := rl.Commit(ctx, "holds", hold.ID, 1); err != nil || released != 3 {
+		t.Fatalf("Commit should release 3 units, got %d: %v", released, err)
+	}
+	if _, err := rl.Cancel(ctx, "holds", hold.ID); err != limiter.ErrHoldNotFound {
+		t.Errorf("Expected ErrHoldNotFound after commit, got %v", err)
+	}
+
+	first, err := rl.Allow(ctx, "holds", "req-1")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	retry, err := rl.Allow(ctx, "holds", "req-1")
+	if err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	if !retry.Duplicate || retry.Remaining != first.Remaining {
+		t.Errorf("Retry should be a duplicate with remaining %d, got duplicate=%v remaining=%d",
+			first.Remaining, retry.Duplicate, retry.Remaining)
+	}
+}
+
+// TestMemoryStoreHoldOutlivesWindow checks that an open hold keeps its
+// units for its whole timeout, not just for the window it was taken in.
+func TestMemoryStoreHoldOutlivesWindow(t *testing.T) {
+	ctx := context.Background()
+	rl, err := limiter.NewRateLimiter(memoryConfig(), 5, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer rl.Close()
+	clock := newFakeClock()
+	rl.Clock = clock
+
+	hold, err := rl.Hold(ctx, "long-hold", 4, 5*time.Minute)
+	if err != nil || !hold.Allowed {
+		t.Fatalf("Hold should succeed: %v", err)
+	}
+	clock.Advance(2 * time.Minute)
+
+	resp, err := rl.AllowN(ctx, "long-hold", "", 2)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.Allowed || resp.Remaining != 1 {
+		t.Errorf("Expected denied with 1 remaining while the hold is open, got allowed=%v remaining=%d", resp.Allowed, resp.Remaining)
+	}
+
+	if released, err := rl.Commit(ctx, "long-hold", hold.ID, 3); err != nil || released != 1 {
+		t.Fatalf("Commit should release 1 unit, got %d: %v", released, err)
+	}
+	if resp, err := rl.AllowN(ctx, "long-hold", "", 3); err != nil || resp.Allowed {
+		t.Errorf("Committed units should count from the commit: %v", err)
+	}
+	clock.Advance(2 * time.Minute)
+	if resp, err := rl.AllowN(ctx, "long-hold", "", 5); err != nil || !resp.Allowed {
+		t.Errorf("Request a window after the commit should be allowed: %v", err)
+	}
+}
+
+func TestMemoryStoreConcurrentAllow(t *testing.T) {
+	rl, err := limiter.NewRateLimiter(memoryConfig(), 100, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer rl.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				resp, err := rl.Allow(context.Background(), "concurrent", "")
+				if err != nil {
+					t.Errorf("Request failed: %v", err)
+					return
+				}
+				if resp.Allowed {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 100 {
+		t.Errorf("Expected exactly 100 allowed, got %d", allowed)
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := limiter.NewMemoryStore(4, 10*time.Millisecond)
+	defer store.Close()
+
+	if _, err := store.IncrementByWithExpiry(ctx, "expiring", 3, 20*time.Millisecond); err != nil {
+		t.Fatalf("Increment failed: %v", err)
+	}
+	if count, _ := store.GetCount(ctx, "expiring"); count != 3 {
+		t.Errorf("Expected count 3, got %d", count)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if count, _ := store.GetCount(ctx, "expiring"); count != 0 {
+		t.Errorf("Expected the key to have expired, got %d", count)
+	}
+}
+
+func TestMemoryStoreAllowBatch(t *testing.T) {
+	ctx := context.Background()
+	algorithms := []string{
+		limiter.AlgorithmSlidingLog,
+		limiter.AlgorithmSlidingWindow,
+		limiter.AlgorithmFixedWindow,
+		limiter.AlgorithmTokenBucket,
+		limiter.AlgorithmGCRA,
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			rl, err := limiter.NewFromPolicy(memoryConfig(), limiter.Policy{
+				Algorithm: algorithm,
+				Limit:     3,
+				Window:    time.Hour,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create limiter: %v", err)
+			}
+			defer rl.Close()
+
+			results := limiter.AllowBatch(ctx, rl, []limiter.Check{
+				{Key: "a", Cost: 2},
+				{Key: "b", Cost: 1},
+				{Key: "a", Cost: -1},
+				{Key: "a", Cost: 2},
+				{Key: "a", Cost: 1},
+			})
+			if len(results) != 5 {
+				t.Fatalf("Expected 5 results, got %d", len(results))
+			}
+			if results[2].Err == nil {
+				t.Error("Expected an error for a negative cost")
+			}
+			for i, allowed := range []bool{true, true, false, false, true} {
+				if i == 2 {
+					continue
+				}
+				if results[i].Err != nil {
+					t.Fatalf("Check %d failed: %v", i, results[i].Err)
+				}
+				if results[i].Response.Allowed != allowed {
+					t.Errorf("Check %d: expected allowed=%v", i, allowed)
+				}
+			}
+			if results[4].Response.Remaining != 0 {
+				t.Errorf("Expected the last check of a to leave 0 remaining, got %d", results[4].Response.Remaining)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreCoalescedAllow(t *testing.T) {
+	cfg := memoryConfig()
+	cfg.RateLimit.CoalesceWindow = time.Millisecond
+	rl, err := limiter.NewRateLimiter(cfg, 20, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer rl.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	remaining := make(map[int]bool)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := rl.Allow(context.Background(), "coalesced", "")
+			if err != nil {
+				t.Errorf("Request failed: %v", err)
+				return
+			}
+			if resp.Allowed {
+				mu.Lock()
+				remaining[resp.Remaining] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(remaining) != 20 {
+		t.Errorf("Expected 20 allowed requests with distinct remaining counts, got %d", len(remaining))
+	}
+}
+
+func TestMemoryStoreFixedWindowDeniedCost(t *testing.T) {
+	ctx := context.Background()
+	fw, err := limiter.NewFixedWindowLimiter(memoryConfig(), 5, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer fw.Close()
+
+	if _, err := fw.AllowN(ctx, "fw-cost", "", 3); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp, err := fw.AllowN(ctx, "fw-cost", "", 3)
+	if err != nil {
+		t.Fatalf("Request over limit failed: %v", err)
+	}
+	if resp.Allowed || resp.Remaining != 2 {
+		t.Errorf("Expected denied with 2 remaining, got %+v", resp)
+	}
+	if resp, err := fw.AllowN(ctx, "fw-cost", "", 2); err != nil || !resp.Allowed {
+		t.Errorf("The denied units should not be charged: %+v, %v", resp, err)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"testing"
 	"time"
 
+	goredis "github.com/go-redis/redis/v8"
 	"github.com/mshort2/distributed-rate-limiter/internal/config"
 	"github.com/mshort2/distributed-rate-limiter/internal/middleware"
 	limiter "github.com/mshort2/distributed-rate-limiter/pkg/ratelimiter"
+	"github.com/mshort2/distributed-rate-limiter/pkg/redis"
 )
 
 func TestSlidingWindowLimiter(t *testing.T) {
@@ -17,15 +19,22 @@ func TestSlidingWindowLimiter(t *testing.T) {
 		t.Fatalf("Failed to create rate limiter: %v", err)
 	}
 
+	clock := newFakeClock()
+	limiter.Clock = clock
+
 	clientID := "test-client"
-	_, _ = limiter.RedisDB.ZRemRangeByScore(context.Background(), clientID, "0", "+inf")
+	if err := limiter.Reset(context.Background(), clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
 	t.Run("allows requests within limit", func(t *testing.T) {
 		for i := 0; i < 5; i++ {
-			counter, err := limiter.RedisDB.ZCard(context.Background(), clientID)
+			peek, err := limiter.Peek(context.Background(), clientID)
 			if err != nil {
-				t.Fatalf("Failed to get ZCard: %v", err)
+				t.Fatalf("Failed to peek: %v", err)
+			}
+			if peek.Remaining != 5-i {
+				t.Errorf("Peek expected remaining %d, got %d", 5-i, peek.Remaining)
 			}
-			t.Logf("Current count: %d", counter)
 			requestID := middleware.GenerateRequestID()
 			resp, err := limiter.Allow(context.Background(), clientID, requestID)
 			t.Logf("i: %d, remaining: %d", i, resp.Remaining)
@@ -40,6 +49,7 @@ func TestSlidingWindowLimiter(t *testing.T) {
 			if resp.Remaining != expectedRemaining {
 				t.Errorf("Expected remaining %d, got %d", expectedRemaining, resp.Remaining)
 			}
+			clock.Advance(100 * time.Millisecond)
 		}
 	})
 
@@ -54,10 +64,17 @@ func TestSlidingWindowLimiter(t *testing.T) {
 		if resp.Remaining != 0 {
 			t.Errorf("Expected remaining 0, got %d", resp.Remaining)
 		}
+		// The oldest entry frees up within the 2s window, not a full window from now
+		if resp.RetryAfterMs <= 0 || resp.RetryAfterMs >= 2000 {
+			t.Errorf("Expected retry after within the window, got %dms", resp.RetryAfterMs)
+		}
+		if !resp.ResetTime.Before(clock.Now().Add(2 * time.Second)) {
+			t.Errorf("Expected reset when the oldest entry expires, got %v", resp.ResetTime)
+		}
 	})
 
 	t.Run("sliding window resets after expiry", func(t *testing.T) {
-		time.Sleep(2 * time.Second)
+		clock.Advance(2 * time.Second)
 		resp, err := limiter.Allow(context.Background(), clientID, middleware.GenerateRequestID())
 		if err != nil {
 			t.Fatalf("Request after window failed: %v", err)
@@ -121,3 +138,492 @@ func TestMultipleClients(t *testing.T) {
 		}
 	})
 }
+
+func TestTokenBucketLimiter(t *testing.T) {
+	cfg := config.Load()
+	tb, err := limiter.NewTokenBucketLimiter(cfg, 1, 3)
+	if err != nil {
+		t.Fatalf("Failed to create token bucket limiter: %v", err)
+	}
+	defer tb.Close()
+	clock := newFakeClock()
+	tb.Clock = clock
+
+	clientID := "tb-client"
+	if err := tb.Reset(context.Background(), clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
+
+	t.Run("allows a burst up to capacity", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			resp, err := tb.Allow(context.Background(), clientID, middleware.GenerateRequestID())
+			if err != nil {
+				t.Fatalf("Request %d failed: %v", i, err)
+			}
+			if !resp.Allowed {
+				t.Fatalf("Request %d should be allowed", i)
+			}
+			if resp.Remaining != 2-i {
+				t.Errorf("Expected remaining %d, got %d", 2-i, resp.Remaining)
+			}
+		}
+	})
+
+	t.Run("blocks once the bucket is empty", func(t *testing.T) {
+		resp, err := tb.Allow(context.Background(), clientID, middleware.GenerateRequestID())
+		if err != nil {
+			t.Fatalf("Request over burst failed: %v", err)
+		}
+		if resp.Allowed {
+			t.Error("Request should be blocked")
+		}
+	})
+
+	t.Run("refills at the steady rate", func(t *testing.T) {
+		clock.Advance(1100 * time.Millisecond)
+		peek, err := tb.Peek(context.Background(), clientID)
+		if err != nil {
+			t.Fatalf("Peek failed: %v", err)
+		}
+		if !peek.Allowed || peek.Remaining != 1 {
+			t.Errorf("Expected one refilled token, got allowed=%v remaining=%d", peek.Allowed, peek.Remaining)
+		}
+	})
+}
+
+func TestGCRALimiter(t *testing.T) {
+	cfg := config.Load()
+	gcra, err := limiter.NewGCRALimiter(cfg, 3, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create GCRA limiter: %v", err)
+	}
+	defer gcra.Close()
+
+	clientID := "gcra-client"
+	if err := gcra.Reset(context.Background(), clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := gcra.Allow(context.Background(), clientID, middleware.GenerateRequestID())
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if !resp.Allowed {
+			t.Fatalf("Request %d should be allowed", i)
+		}
+		if resp.Remaining != 2-i {
+			t.Errorf("Expected remaining %d, got %d", 2-i, resp.Remaining)
+		}
+	}
+
+	resp, err := gcra.Allow(context.Background(), clientID, middleware.GenerateRequestID())
+	if err != nil {
+		t.Fatalf("Request over limit failed: %v", err)
+	}
+	if resp.Allowed {
+		t.Error("Request should be blocked")
+	}
+	// One emission interval is 1s, minus the little time spent above.
+	if resp.RetryAfterMs <= 900 || resp.RetryAfterMs > 1000 {
+		t.Errorf("Expected retry after just under 1000ms, got %d", resp.RetryAfterMs)
+	}
+}
+
+func TestSlidingWindowCounterPolicy(t *testing.T) {
+	cfg := config.Load()
+	rl, err := limiter.NewFromPolicy(cfg, limiter.Policy{
+		Algorithm: limiter.AlgorithmSlidingWindow,
+		Limit:     3,
+		Window:    time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer rl.Close()
+
+	if _, ok := rl.(*limiter.SlidingWindowCounterLimiter); !ok {
+		t.Fatalf("Expected *SlidingWindowCounterLimiter, got %T", rl)
+	}
+
+	clientID := "swc-client"
+	if err := rl.Reset(context.Background(), clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := rl.Allow(context.Background(), clientID, middleware.GenerateRequestID())
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if !resp.Allowed {
+			t.Fatalf("Request %d should be allowed", i)
+		}
+	}
+
+	resp, err := rl.Allow(context.Background(), clientID, middleware.GenerateRequestID())
+	if err != nil {
+		t.Fatalf("Request over limit failed: %v", err)
+	}
+	if resp.Allowed {
+		t.Error("Request should be blocked")
+	}
+}
+
+func TestFixedWindowLimiter(t *testing.T) {
+	cfg := config.Load()
+	fw, err := limiter.NewFixedWindowLimiter(cfg, 2, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create fixed window limiter: %v", err)
+	}
+	defer fw.Close()
+
+	clientID := "fw-client"
+	if err := fw.Reset(context.Background(), clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
+
+	var resp limiter.RateLimitResponse
+	for i := 0; i < 3; i++ {
+		resp, err = fw.Allow(context.Background(), clientID, middleware.GenerateRequestID())
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if resp.Allowed != (i < 2) {
+			t.Errorf("Request %d: expected allowed=%v, got %v", i, i < 2, resp.Allowed)
+		}
+	}
+
+	expectedReset := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+	if !resp.ResetTime.Equal(expectedReset) {
+		t.Errorf("Expected reset at %v, got %v", expectedReset, resp.ResetTime)
+	}
+	if resp.RetryAfterMs <= 0 {
+		t.Errorf("Expected a positive retry after, got %d", resp.RetryAfterMs)
+	}
+}
+
+func TestSlidingWindowLimiterCost(t *testing.T) {
+	cfg := config.Load()
+	limiter, err := limiter.NewRateLimiter(cfg, 5, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer limiter.Close()
+
+	clientID := "cost-client"
+	if err := limiter.Reset(context.Background(), clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
+
+	resp, err := limiter.AllowN(context.Background(), clientID, middleware.GenerateRequestID(), 3)
+	if err != nil {
+		t.Fatalf("First request failed: %v", err)
+	}
+	if !resp.Allowed || resp.Remaining != 2 {
+		t.Errorf("Expected allowed with 2 remaining, got allowed=%v remaining=%d", resp.Allowed, resp.Remaining)
+	}
+
+	// A denied request must not consume any of its units
+	resp, err = limiter.AllowN(context.Background(), clientID, middleware.GenerateRequestID(), 3)
+	if err != nil {
+		t.Fatalf("Second request failed: %v", err)
+	}
+	if resp.Allowed || resp.Remaining != 2 {
+		t.Errorf("Expected denied with 2 remaining, got allowed=%v remaining=%d", resp.Allowed, resp.Remaining)
+	}
+}
+
+func TestMultiLimiter(t *testing.T) {
+	cfg := config.Load()
+	ml, err := limiter.NewMultiLimiter(cfg,
+		limiter.Rule{Name: "per-minute", Limit: 2, Window: time.Minute},
+		limiter.Rule{Name: "per-hour", Limit: 5, Window: time.Hour},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create multi limiter: %v", err)
+	}
+	defer ml.Close()
+
+	clientID := "multi-client"
+	if err := ml.Reset(context.Background(), clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := ml.Allow(context.Background(), clientID, middleware.GenerateRequestID())
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if !resp.Allowed {
+			t.Fatalf("Request %d should be allowed", i)
+		}
+	}
+
+	resp, err := ml.Allow(context.Background(), clientID, middleware.GenerateRequestID())
+	if err != nil {
+		t.Fatalf("Request over limit failed: %v", err)
+	}
+	if resp.Allowed {
+		t.Fatal("Request should be blocked by the per-minute rule")
+	}
+	if resp.ViolatedLimit != "per-minute" {
+		t.Errorf("Expected violated limit per-minute, got %q", resp.ViolatedLimit)
+	}
+	// The denied request must not have been charged to the hourly rule
+	if len(resp.Limits) != 2 || resp.Limits[1].Remaining != 3 {
+		t.Errorf("Expected 3 remaining on per-hour, got %+v", resp.Limits)
+	}
+}
+
+func TestMultiLimiterRetryBetweenWindows(t *testing.T) {
+	cfg := config.Load()
+	ctx := context.Background()
+	ml, err := limiter.NewMultiLimiter(cfg,
+		limiter.Rule{Name: "per-minute", Limit: 2, Window: time.Minute},
+		limiter.Rule{Name: "per-hour", Limit: 5, Window: time.Hour},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create multi limiter: %v", err)
+	}
+	defer ml.Close()
+	clock := newFakeClock()
+	ml.Clock = clock
+
+	clientID := "multi-retry-client"
+	if err := ml.Reset(ctx, clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
+
+	requestID := middleware.GenerateRequestID()
+	if resp, err := ml.Allow(ctx, clientID, requestID); err != nil || !resp.Allowed {
+		t.Fatalf("Request should be allowed: %v", err)
+	}
+
+	// The retry arrives after the per-minute window but within the hour
+	clock.Advance(2 * time.Minute)
+	retry, err := ml.Allow(ctx, clientID, requestID)
+	if err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	if !retry.Allowed || !retry.Duplicate {
+		t.Errorf("Retry should be an allowed duplicate, got allowed=%v duplicate=%v", retry.Allowed, retry.Duplicate)
+	}
+	if len(retry.Limits) != 2 || retry.Limits[1].Remaining != 4 {
+		t.Errorf("Expected 4 remaining on per-hour, got %+v", retry.Limits)
+	}
+}
+
+func TestHierarchicalLimiter(t *testing.T) {
+	cfg := config.Load()
+	hl, err := limiter.NewHierarchicalLimiter(cfg,
+		limiter.Rule{Limit: 5, Window: time.Minute},
+		limiter.Rule{Limit: 3, Window: time.Minute},
+		limiter.Rule{Limit: 10000, Window: time.Minute},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create hierarchical limiter: %v", err)
+	}
+	defer hl.Close()
+
+	// A fresh org per run, since only user scopes can be reset
+	org := "org-" + middleware.GenerateRequestID()
+	alice := limiter.Scope{Org: org, User: "alice"}
+	bob := limiter.Scope{Org: org, User: "bob"}
+	for _, s := range []limiter.Scope{alice, bob} {
+		if err := hl.Reset(context.Background(), s.User); err != nil {
+			t.Fatalf("Failed to reset %s: %v", s.User, err)
+		}
+	}
+
+	for i, s := range []limiter.Scope{alice, alice, bob} {
+		resp, err := hl.AllowScoped(context.Background(), s, middleware.GenerateRequestID(), 1)
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if !resp.Allowed {
+			t.Fatalf("Request %d should be allowed", i)
+		}
+	}
+
+	resp, err := hl.AllowScoped(context.Background(), bob, middleware.GenerateRequestID(), 1)
+	if err != nil {
+		t.Fatalf("Request over org budget failed: %v", err)
+	}
+	if resp.Allowed {
+		t.Fatal("Request should be blocked by the org budget")
+	}
+	if resp.ViolatedLimit != limiter.ScopeOrg {
+		t.Errorf("Expected violated limit %q, got %q", limiter.ScopeOrg, resp.ViolatedLimit)
+	}
+	if resp.Limits[0].Remaining != 4 {
+		t.Errorf("Expected bob to keep 4 user units, got %d", resp.Limits[0].Remaining)
+	}
+}
+
+func TestSlidingWindowLimiterHolds(t *testing.T) {
+	cfg := config.Load()
+	limiter, err := limiter.NewRateLimiter(cfg, 5, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer limiter.Close()
+
+	ctx := context.Background()
+	clientID := "hold-client"
+	if err := limiter.Reset(ctx, clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
+
+	hold, err := limiter.Hold(ctx, clientID, 4, time.Minute)
+	if err != nil {
+		t.Fatalf("Hold failed: %v", err)
+	}
+	if !hold.Allowed || hold.ID == "" || hold.Remaining != 1 {
+		t.Fatalf("Expected a hold with 1 remaining, got %+v", hold)
+	}
+
+	released, err := limiter.Commit(ctx, clientID, hold.ID, 1)
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if released != 3 {
+		t.Errorf("Expected 3 units released, got %d", released)
+	}
+	if _, err := limiter.Cancel(ctx, clientID, hold.ID); err == nil {
+		t.Error("Cancelling a committed hold should fail")
+	}
+
+	t.Run("uncommitted holds expire", func(t *testing.T) {
+		short, err := limiter.Hold(ctx, clientID, 4, 50*time.Millisecond)
+		if err != nil || !short.Allowed {
+			t.Fatalf("Short hold failed: %+v, %v", short, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		resp, err := limiter.AllowN(ctx, clientID, middleware.GenerateRequestID(), 4)
+		if err != nil {
+			t.Fatalf("Request after hold expiry failed: %v", err)
+		}
+		if !resp.Allowed || resp.Remaining != 0 {
+			t.Errorf("Expected the expired hold to be returned, got allowed=%v remaining=%d", resp.Allowed, resp.Remaining)
+		}
+	})
+}
+
+func TestSlidingWindowLimiterIdempotency(t *testing.T) {
+	cfg := config.Load()
+	limiter, err := limiter.NewRateLimiter(cfg, 2, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer limiter.Close()
+
+	clientID := "idempotent-client"
+	if err := limiter.Reset(context.Background(), clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
+
+	requestID := middleware.GenerateRequestID()
+	for i := 0; i < 3; i++ {
+		resp, err := limiter.Allow(context.Background(), clientID, requestID)
+		if err != nil {
+			t.Fatalf("Attempt %d failed: %v", i, err)
+		}
+		if !resp.Allowed || resp.Remaining != 1 {
+			t.Errorf("Attempt %d: expected allowed with 1 remaining, got allowed=%v remaining=%d", i, resp.Allowed, resp.Remaining)
+		}
+		if resp.Duplicate != (i > 0) {
+			t.Errorf("Attempt %d: expected duplicate=%v", i, i > 0)
+		}
+	}
+
+	resp, err := limiter.Allow(context.Background(), clientID, middleware.GenerateRequestID())
+	if err != nil {
+		t.Fatalf("New request failed: %v", err)
+	}
+	if !resp.Allowed || resp.Remaining != 0 {
+		t.Errorf("Expected a new request to be charged, got allowed=%v remaining=%d", resp.Allowed, resp.Remaining)
+	}
+}
+
+func TestSlidingWindowLimiterScriptReload(t *testing.T) {
+	cfg := config.Load()
+	ctx := context.Background()
+	rl, err := limiter.NewRateLimiter(cfg, 5, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer rl.Close()
+	client, ok := rl.Store.(*redis.Client)
+	if !ok {
+		t.Skip("the script cache needs the Redis store")
+	}
+
+	clientID := "test-client-script-reload"
+	if err := rl.Reset(ctx, clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
+
+	// Simulate a restarted server by emptying its script cache
+	rdb := goredis.NewClient(&goredis.Options{
+		Addr:     cfg.Redis.Host + ":" + cfg.Redis.Port,
+		Password: cfg.Redis.Password,
+	})
+	defer rdb.Close()
+	if err := rdb.ScriptFlush(ctx).Err(); err != nil {
+		t.Fatalf("Failed to flush scripts: %v", err)
+	}
+
+	resp, err := rl.Allow(ctx, clientID, middleware.GenerateRequestID())
+	if err != nil {
+		t.Fatalf("Request after script flush failed: %v", err)
+	}
+	if !resp.Allowed || resp.Remaining != 4 {
+		t.Errorf("Expected allowed with 4 remaining, got allowed=%v remaining=%d", resp.Allowed, resp.Remaining)
+	}
+	if reloads := client.ScriptReloads(); reloads != 1 {
+		t.Errorf("Expected 1 script reload, got %d", reloads)
+	}
+}
+
+func TestRedisTimeSource(t *testing.T) {
+	cfg := config.Load()
+	if cfg.Store.Backend == limiter.StoreMemory {
+		t.Skip("the nodes need a shared Redis store")
+	}
+	cfg.RateLimit.TimeSource = limiter.TimeRedis
+	ctx := context.Background()
+
+	// Two nodes whose clocks are an hour apart still share one window
+	nodes := make([]*limiter.SlidingWindowLimiter, 2)
+	for i := range nodes {
+		rl, err := limiter.NewRateLimiter(cfg, 2, time.Minute)
+		if err != nil {
+			t.Fatalf("Failed to create rate limiter: %v", err)
+		}
+		defer rl.Close()
+		nodes[i] = rl
+	}
+	skewed := newFakeClock()
+	skewed.Advance(time.Hour)
+	nodes[1].Clock = skewed
+
+	clientID := "test-client-redis-time"
+	if err := nodes[0].Reset(ctx, clientID); err != nil {
+		t.Fatalf("Failed to reset client: %v", err)
+	}
+
+	for i, allowed := range []bool{true, true, false} {
+		resp, err := nodes[i%2].Allow(ctx, clientID, "")
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if resp.Allowed != allowed {
+			t.Errorf("Request %d: expected allowed=%v", i, allowed)
+		}
+		if !allowed && (resp.RetryAfterMs <= 0 || resp.RetryAfterMs > time.Minute.Milliseconds()) {
+			t.Errorf("Expected a retry hint within the window, got %dms", resp.RetryAfterMs)
+		}
+	}
+}
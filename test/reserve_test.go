@@ -0,0 +1,74 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	limiter "github.com/mshort2/distributed-rate-limiter/pkg/ratelimiter"
+)
+
+func TestReserveAndWait(t *testing.T) {
+	rl := newFakeLimiter(1)
+
+	r, err := limiter.Reserve(context.Background(), rl, "reserve-client", 1)
+	if err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if !r.OK || r.Delay != 0 {
+		t.Fatalf("Expected an immediate reservation, got %+v", r)
+	}
+
+	r, err = limiter.Reserve(context.Background(), rl, "reserve-client", 1)
+	if err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if r.OK {
+		t.Fatal("Second reservation should be delayed")
+	}
+	if r.Delay < 59*time.Second || r.Delay > time.Minute {
+		t.Errorf("Expected a delay of about a minute, got %v", r.Delay)
+	}
+
+	t.Run("wait gives up before the deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		start := time.Now()
+		if err := limiter.Wait(ctx, rl, "reserve-client"); err == nil {
+			t.Fatal("Wait should fail when the delay exceeds the deadline")
+		}
+		if time.Since(start) > 100*time.Millisecond {
+			t.Error("Wait should return without sleeping")
+		}
+	})
+
+	t.Run("wait honors cancellation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		if err := limiter.Wait(ctx, rl, "reserve-client"); err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	})
+	t.Run("wait rejects a cost over the limit", func(t *testing.T) {
+		rl, err := limiter.NewRateLimiter(memoryConfig(), 2, time.Minute)
+		if err != nil {
+			t.Fatalf("Failed to create limiter: %v", err)
+		}
+		defer rl.Close()
+
+		done := make(chan error, 1)
+		go func() { done <- limiter.WaitN(context.Background(), rl, "reserve-large", 3) }()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Error("WaitN should fail for a cost over the limit")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("WaitN should return at once for a cost over the limit")
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+	limiter "github.com/mshort2/distributed-rate-limiter/pkg/ratelimiter"
+)
+
+// TestSentinelFailover forces a failover and checks that the limiter keeps
+// working against the promoted master, whose script cache starts empty.
+func TestSentinelFailover(t *testing.T) {
+	if os.Getenv("REDIS_SENTINEL_ADDRS") == "" {
+		t.Skip("REDIS_SENTINEL_ADDRS not set")
+	}
+	cfg := config.Load()
+	ctx := context.Background()
+
+	rl, err := limiter.NewRateLimiter(cfg, 100, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer rl.Close()
+
+	clientID := "sentinel-client"
+	if err := rl.Reset(ctx, clientID); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if _, err := rl.Allow(ctx, clientID, ""); err != nil {
+		t.Fatalf("Allow before failover failed: %v", err)
+	}
+
+	sentinel := goredis.NewSentinelClient(&goredis.Options{
+		Addr:     cfg.Redis.SentinelAddrs[0],
+		Password: cfg.Redis.SentinelPassword,
+	})
+	defer sentinel.Close()
+
+	before, err := sentinel.GetMasterAddrByName(ctx, cfg.Redis.SentinelMaster).Result()
+	if err != nil {
+		t.Fatalf("Failed to get master address: %v", err)
+	}
+	if err := sentinel.Failover(ctx, cfg.Redis.SentinelMaster).Err(); err != nil {
+		t.Fatalf("Failover failed: %v", err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		after, err := sentinel.GetMasterAddrByName(ctx, cfg.Redis.SentinelMaster).Result()
+		if err == nil && after[0]+":"+after[1] != before[0]+":"+before[1] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Master %v was not replaced", before)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// Allow errors until the client has reconnected to the new master, and
+	// from then on must succeed without a restart.
+	for {
+		_, err := rl.Allow(ctx, clientID, "")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Allow after failover failed: %v", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
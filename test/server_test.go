@@ -0,0 +1,371 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+	"github.com/mshort2/distributed-rate-limiter/internal/server"
+	limiter "github.com/mshort2/distributed-rate-limiter/pkg/ratelimiter"
+)
+
+// fakeLimiter allows the first limit requests per key and denies the rest,
+// so the HTTP layer can be exercised without Redis.
+type fakeLimiter struct {
+	limit  int
+	counts map[string]int
+}
+
+func newFakeLimiter(limit int) *fakeLimiter {
+	return &fakeLimiter{limit: limit, counts: make(map[string]int)}
+}
+
+func (f *fakeLimiter) Allow(ctx context.Context, key string, requestID string) (limiter.RateLimitResponse, error) {
+	return f.AllowN(ctx, key, requestID, 1)
+}
+
+func (f *fakeLimiter) AllowN(ctx context.Context, key string, requestID string, cost int) (limiter.RateLimitResponse, error) {
+	resp, _ := f.Peek(ctx, key)
+	resp.Allowed = resp.Remaining >= cost
+	if resp.Allowed {
+		f.counts[key] += cost
+		resp.Remaining -= cost
+	} else {
+		resp.RetryAfterMs = time.Until(resp.ResetTime).Milliseconds()
+	}
+	resp.RequestID = requestID
+	return resp, nil
+}
+
+func (f *fakeLimiter) Peek(ctx context.Context, key string) (limiter.RateLimitResponse, error) {
+	remaining := f.limit - f.counts[key]
+	return limiter.RateLimitResponse{
+		Allowed:   remaining > 0,
+		Remaining: remaining,
+		ResetTime: time.Now().Add(time.Minute),
+		ClientID:  key,
+	}, nil
+}
+
+func (f *fakeLimiter) Reset(ctx context.Context, key string) error {
+	delete(f.counts, key)
+	return nil
+}
+
+func (f *fakeLimiter) Health(ctx context.Context) error { return nil }
+
+func (f *fakeLimiter) Close() error { return nil }
+
+func TestServerWithFakeLimiter(t *testing.T) {
+	cfg := config.Load()
+	srv := server.NewServerWithLimiter(cfg, newFakeLimiter(2))
+
+	expected := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	for i, status := range expected {
+		req, err := http.NewRequest("POST", "/check", nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("X-Client-ID", "fake-client")
+
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		if rr.Code != status {
+			t.Errorf("Request %d: expected status %d, got %d", i, status, rr.Code)
+		}
+		if status == http.StatusTooManyRequests && rr.Header().Get("Retry-After") != "60" {
+			t.Errorf("Request %d: expected Retry-After 60, got %q", i, rr.Header().Get("Retry-After"))
+		}
+
+		var response limiter.RateLimitResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if response.ClientID != "fake-client" {
+			t.Errorf("Expected client_id fake-client, got %q", response.ClientID)
+		}
+	}
+}
+
+func TestServerCheckCost(t *testing.T) {
+	cfg := config.Load()
+	srv := server.NewServerWithLimiter(cfg, newFakeLimiter(5))
+
+	tests := []struct {
+		body              string
+		expectedStatus    int
+		expectedRemaining int
+	}{
+		{body: `{"cost": 3}`, expectedStatus: http.StatusOK, expectedRemaining: 2},
+		{body: `{"cost": 3}`, expectedStatus: http.StatusTooManyRequests, expectedRemaining: 2},
+		{body: `{"cost": 2}`, expectedStatus: http.StatusOK, expectedRemaining: 0},
+		{body: `{"cost": -1}`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", "/check", bytes.NewBufferString(tt.body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("X-Client-ID", "cost-client")
+
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Fatalf("Request %d: expected status %d, got %d", i, tt.expectedStatus, rr.Code)
+		}
+		if rr.Code == http.StatusBadRequest {
+			continue
+		}
+
+		var response limiter.RateLimitResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if response.Remaining != tt.expectedRemaining {
+			t.Errorf("Request %d: expected remaining %d, got %d", i, tt.expectedRemaining, response.Remaining)
+		}
+	}
+}
+
+func TestServerDryRun(t *testing.T) {
+	cfg := config.Load()
+	srv := server.NewServerWithLimiter(cfg, newFakeLimiter(2))
+
+	do := func(method, path string) (int, limiter.RateLimitResponse) {
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("X-Client-ID", "dry-client")
+
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		var response limiter.RateLimitResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return rr.Code, response
+	}
+
+	do("POST", "/check")
+
+	// Repeated dry runs must not consume quota
+	for i := 0; i < 2; i++ {
+		code, response := do("GET", "/check?dry_run=true")
+		if code != http.StatusOK {
+			t.Fatalf("Dry run %d: expected status 200, got %d", i, code)
+		}
+		if !response.Allowed || response.Remaining != 1 {
+			t.Errorf("Dry run %d: expected allowed with 1 remaining, got allowed=%v remaining=%d", i, response.Allowed, response.Remaining)
+		}
+	}
+
+	code, response := do("GET", "/check?dry_run=true&cost=2")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if response.Allowed {
+		t.Error("A dry run for 2 units should not be allowed with 1 remaining")
+	}
+}
+
+// trippedLimiter is a fakeLimiter whose store circuit is open.
+type trippedLimiter struct {
+	*fakeLimiter
+}
+
+func (trippedLimiter) CircuitState() string { return "open" }
+
+func TestServerHealthCircuit(t *testing.T) {
+	cfg := config.Load()
+	srv := server.NewServerWithLimiter(cfg, trippedLimiter{newFakeLimiter(1)})
+
+	req, err := http.NewRequest("GET", "/health", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+
+	var health map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &health); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if health["circuit"] != "open" {
+		t.Errorf("Expected circuit open in health, got %v", health)
+	}
+}
+
+func TestServerBatch(t *testing.T) {
+	rl, err := limiter.NewRateLimiter(memoryConfig(), 2, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	defer rl.Close()
+	srv := server.NewServerWithLimiter(config.Load(), rl)
+
+	body := `{"checks": [
+		{"key": "ip:1"},
+		{"key": "route:a", "cost": 2},
+		{"key": "ip:1", "cost": 2},
+		{"key": ""},
+		{"key": "ip:2", "cost": -1}
+	]}`
+	req, err := http.NewRequest("POST", "/check/batch", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Results []struct {
+			Allowed   *bool  `json:"allowed"`
+			Remaining int    `json:"remaining"`
+			Error     string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(response.Results) != 5 {
+		t.Fatalf("Expected 5 results, got %d", len(response.Results))
+	}
+
+	expected := []struct {
+		allowed   bool
+		remaining int
+		failed    bool
+	}{
+		{allowed: true, remaining: 1},
+		{allowed: true, remaining: 0},
+		{allowed: false, remaining: 1},
+		{failed: true},
+		{failed: true},
+	}
+	for i, want := range expected {
+		got := response.Results[i]
+		if want.failed {
+			if got.Error == "" || got.Allowed != nil {
+				t.Errorf("Check %d: expected only an error, got %+v", i, got)
+			}
+			continue
+		}
+		if got.Error != "" || got.Allowed == nil {
+			t.Fatalf("Check %d: expected a decision, got error %q", i, got.Error)
+		}
+		if *got.Allowed != want.allowed || got.Remaining != want.remaining {
+			t.Errorf("Check %d: expected allowed=%v remaining=%d, got allowed=%v remaining=%d",
+				i, want.allowed, want.remaining, *got.Allowed, got.Remaining)
+		}
+	}
+
+	tooMany := `{"checks": [` + strings.Repeat(`{"key": "k"},`, 100) + `{"key": "k"}]}`
+	req, _ = http.NewRequest("POST", "/check/batch", bytes.NewBufferString(tooMany))
+	rr = httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an oversized batch, got %d", rr.Code)
+	}
+}
+
+func TestServerKeyLimits(t *testing.T) {
+	t.Setenv("KEY_LIMITS", "bulk-=fixed_window:3/1m")
+	cfg := memoryConfig()
+	cfg.RateLimit.Algorithm = limiter.AlgorithmSlidingLog
+	cfg.RateLimit.DefaultLimit = 2
+	cfg.RateLimit.DefaultWindow = time.Minute
+	srv := server.NewServer(cfg)
+
+	check := func(clientID string) (int, limiter.RateLimitResponse) {
+		req := httptest.NewRequest("POST", "/check", nil)
+		req.Header.Set("X-Client-ID", clientID)
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		var response limiter.RateLimitResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return rr.Code, response
+	}
+
+	// The strict key keeps the default sliding log
+	for i := 0; i < 3; i++ {
+		if code, _ := check("strict-client"); (code == http.StatusOK) != (i < 2) {
+			t.Errorf("Strict request %d: unexpected status %d", i, code)
+		}
+	}
+
+	// The bulk key gets its own limit on a fixed window, which resets on
+	// the minute
+	var response limiter.RateLimitResponse
+	for i := 0; i < 4; i++ {
+		var code int
+		code, response = check("bulk-client")
+		if (code == http.StatusOK) != (i < 3) {
+			t.Errorf("Bulk request %d: unexpected status %d", i, code)
+		}
+	}
+	if !response.ResetTime.Equal(response.ResetTime.Truncate(time.Minute)) {
+		t.Errorf("Expected the bulk key to reset on the minute, got %v", response.ResetTime)
+	}
+}
+
+func TestServerHoldValidation(t *testing.T) {
+	cfg := memoryConfig()
+	cfg.RateLimit.Algorithm = limiter.AlgorithmSlidingLog
+	cfg.RateLimit.DefaultLimit = 5
+	cfg.RateLimit.DefaultWindow = time.Minute
+	srv := server.NewServer(cfg)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("X-Client-ID", "hold-validation")
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post("/check/reserve", `{"cost": 2}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Reserve: expected status 200, got %d", rr.Code)
+	}
+	var hold limiter.Hold
+	if err := json.Unmarshal(rr.Body.Bytes(), &hold); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path, body string
+	}{
+		{"/check/reserve", `{"cost": -1}`},
+		{"/check/reserve", `{"cost": 6}`},
+		{"/check/reserve", `{"timeout_ms": -1}`},
+		{"/check/commit", `{"hold_id": "` + hold.ID + `", "used": -1}`},
+		{"/check/commit", `{"hold_id": "` + hold.ID + `", "used": 6}`},
+		{"/check/commit", `{"used": 1}`},
+		{"/check/cancel", `{}`},
+	} {
+		if rr := post(tc.path, tc.body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: expected status 400, got %d", tc.path, tc.body, rr.Code)
+		}
+	}
+
+	if rr := post("/check/commit", `{"hold_id": "`+hold.ID+`", "used": 1}`); rr.Code != http.StatusOK {
+		t.Errorf("Commit after rejected requests: expected status 200, got %d", rr.Code)
+	}
+}
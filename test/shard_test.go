@@ -0,0 +1,155 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/mshort2/distributed-rate-limiter/internal/config"
+	"github.com/mshort2/distributed-rate-limiter/internal/middleware"
+	limiter "github.com/mshort2/distributed-rate-limiter/pkg/ratelimiter"
+	"github.com/mshort2/distributed-rate-limiter/pkg/redis"
+)
+
+// TestShardedStore runs a limiter over independent Redis servers; start two
+// with `make shards-up`.
+func TestShardedStore(t *testing.T) {
+	if os.Getenv("REDIS_SHARD_ADDRS") == "" {
+		t.Skip("REDIS_SHARD_ADDRS not set")
+	}
+	cfg := config.Load()
+	ctx := context.Background()
+
+	rl, err := limiter.NewRateLimiter(cfg, 2, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer rl.Close()
+
+	for i := 0; i < 20; i++ {
+		clientID := "shard-client-" + middleware.GenerateRequestID()
+		for j := 0; j < 3; j++ {
+			resp, err := rl.Allow(ctx, clientID, middleware.GenerateRequestID())
+			if err != nil {
+				t.Fatalf("Request %d for %s failed: %v", j, clientID, err)
+			}
+			if resp.Allowed != (j < 2) {
+				t.Errorf("Request %d for %s: expected allowed=%v", j, clientID, j < 2)
+			}
+		}
+		if err := rl.Reset(ctx, clientID); err != nil {
+			t.Fatalf("Reset %s failed: %v", clientID, err)
+		}
+	}
+
+	health := rl.ShardHealth(ctx)
+	if len(health) != len(cfg.Redis.ShardAddrs) {
+		t.Errorf("Expected health for %d shards, got %v", len(cfg.Redis.ShardAddrs), health)
+	}
+	for addr, status := range health {
+		if status != "healthy" {
+			t.Errorf("Shard %s: %s", addr, status)
+		}
+	}
+}
+
+// TestShardedStoreAddShard checks that adding a shard moves only the keys
+// that hash to it.
+func TestShardedStoreAddShard(t *testing.T) {
+	addrs := strings.Split(os.Getenv("REDIS_SHARD_ADDRS"), ",")
+	if len(addrs) < 2 {
+		t.Skip("REDIS_SHARD_ADDRS needs at least two servers")
+	}
+	ctx := context.Background()
+
+	cfg := config.Load()
+	cfg.Redis.ShardAddrs = addrs[:len(addrs)-1]
+	before, err := redis.NewClient(cfg)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer before.Close()
+
+	cfg = config.Load()
+	after, err := redis.NewClient(cfg)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer after.Close()
+
+	const keys = 200
+	prefix := "shard-move-" + middleware.GenerateRequestID()
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("%s-%d", prefix, i)
+		if _, err := before.IncrementByWithExpiry(ctx, key, 1, time.Minute); err != nil {
+			t.Fatalf("Increment %s failed: %v", key, err)
+		}
+		defer before.Del(ctx, key)
+	}
+
+	moved := 0
+	for i := 0; i < keys; i++ {
+		count, err := after.GetCount(ctx, fmt.Sprintf("%s-%d", prefix, i))
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if count == 0 {
+			moved++
+		}
+	}
+
+	// About one key in len(addrs) should move to the new shard
+	if expected := keys / len(addrs); moved == 0 || moved > expected+keys/4 {
+		t.Errorf("Expected about %d of %d keys to move, %d did", expected, keys, moved)
+	}
+}
+
+// TestShardedStoreScriptReload empties the script cache of one shard, as a
+// restart would, and checks that its keys still get their scripts.
+func TestShardedStoreScriptReload(t *testing.T) {
+	if os.Getenv("REDIS_SHARD_ADDRS") == "" {
+		t.Skip("REDIS_SHARD_ADDRS not set")
+	}
+	cfg := config.Load()
+	ctx := context.Background()
+
+	rl, err := limiter.NewRateLimiter(cfg, 5, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer rl.Close()
+	client, ok := rl.Store.(*redis.Client)
+	if !ok {
+		t.Skip("the script cache needs the Redis store")
+	}
+
+	rdb := goredis.NewClient(&goredis.Options{
+		Addr:     cfg.Redis.ShardAddrs[0],
+		Password: cfg.Redis.Password,
+	})
+	defer rdb.Close()
+
+	// Keys spread over every shard, and the cache is flushed before each so
+	// that a reload sent to the wrong shard would leave the call failing
+	for i := 0; i < 20; i++ {
+		if err := rdb.ScriptFlush(ctx).Err(); err != nil {
+			t.Fatalf("Failed to flush scripts: %v", err)
+		}
+		clientID := "shard-reload-" + middleware.GenerateRequestID()
+		resp, err := rl.Allow(ctx, clientID, middleware.GenerateRequestID())
+		if err != nil {
+			t.Fatalf("Request for %s after script flush failed: %v", clientID, err)
+		}
+		if !resp.Allowed || resp.Remaining != 4 {
+			t.Errorf("Expected allowed with 4 remaining for %s, got allowed=%v remaining=%d", clientID, resp.Allowed, resp.Remaining)
+		}
+		rl.Reset(ctx, clientID)
+	}
+	if reloads := client.ScriptReloads(); reloads == 0 {
+		t.Error("Expected the flushed shard to reload its scripts")
+	}
+}